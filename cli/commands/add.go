@@ -7,6 +7,7 @@ import (
 	"logyard"
 	"logyard/drain"
 	"strings"
+	"time"
 )
 
 // Filters is a slice of message filters
@@ -33,8 +34,9 @@ func (o *Options) Set(value string) error {
 		// default: no options
 		return nil
 	}
-	parts := strings.FieldsFunc(value, func(c rune) bool { return c == '=' })
-	if len(parts) != 2 {
+	// Values may contain '=' (eg: placement=node=10.0.0.1)
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
 		return fmt.Errorf("options must be of the `key=value` format")
 	}
 	key, value := parts[0], parts[1]
@@ -48,10 +50,17 @@ func (o *Options) Set(value string) error {
 // Example:
 //  .. add -uri redis://core -filter systail.kato -o limit=200 -o key=kato_history kato_history
 type add struct {
-	json    bool
-	uri     string
-	filters Filters
-	params  Options
+	json        bool
+	dryrun      bool
+	test        bool
+	uri         string
+	filters     Filters
+	params      Options
+	description string
+	owner       string
+	labels      Options
+	ttl         time.Duration
+	singleton   bool
 }
 
 func (cmd *add) Name() string {
@@ -60,10 +69,22 @@ func (cmd *add) Name() string {
 
 func (cmd *add) DefineFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&cmd.json, "json", false, "Output result as JSON")
+	fs.BoolVar(&cmd.dryrun, "dry-run", false,
+		"Validate and print the drain config, without adding it")
+	fs.BoolVar(&cmd.test, "test", false,
+		"Format a sample message and attempt to connect to the drain")
 	fs.StringVar(&cmd.uri, "uri", "", "Drain URI (eg: udp://logs.loggly.com:12345)")
 	fs.Var(&cmd.filters, "filter", "Message filter")
 	cmd.params = make(map[string]string)
 	fs.Var(&cmd.params, "o", "Drain options (eg: -o 'limit=100' or -o 'format={{.Text}}'")
+	fs.StringVar(&cmd.description, "description", "", "What the drain is for")
+	fs.StringVar(&cmd.owner, "owner", "", "Who to contact about the drain")
+	cmd.labels = make(map[string]string)
+	fs.Var(&cmd.labels, "label", "Drain label (eg: -label team=ops)")
+	fs.BoolVar(&cmd.singleton, "singleton", false,
+		"Run the drain on a single, elected, node (same as -o singleton=true)")
+	fs.DurationVar(&cmd.ttl, "ttl", 0,
+		"Delete the drain after this long (eg: 1h), unless renewed with `renew`")
 }
 
 func (cmd *add) Run(args []string) (string, error) {
@@ -73,20 +94,88 @@ func (cmd *add) Run(args []string) (string, error) {
 	name := args[0]
 	uri := cmd.uri
 
+	if cmd.singleton {
+		cmd.params["singleton"] = "true"
+	}
 	uri, err := drain.ConstructDrainURI(name, cmd.uri, cmd.filters, cmd.params)
 	if err != nil {
 		return "", err
 	}
-	if err = logyard.AddDrain(name, uri); err != nil {
+
+	// validate before saving, so that a broken drain doesn't end up
+	// retrying forever.
+	cfg, err := drain.NewDrainConfig(name, uri)
+	if err != nil {
+		return "", err
+	}
+	if err = drain.ValidateDrainConfig(cfg); err != nil {
+		return "", fmt.Errorf("Invalid drain %s: %s", name, err)
+	}
+
+	if cmd.test {
+		if err = testDrain(cfg); err != nil {
+			return "", err
+		}
+	}
+
+	meta := &logyard.DrainMeta{
+		Description: cmd.description,
+		Owner:       cmd.owner}
+	if len(cmd.labels) > 0 {
+		meta.Labels = cmd.labels
+	}
+	if cmd.ttl < 0 {
+		return "", fmt.Errorf("ttl must be positive")
+	} else if cmd.ttl > 0 {
+		meta.TTL = cmd.ttl.String()
+	}
+
+	if cmd.dryrun {
+		description := cfg.Describe()
+		description["uri"] = uri
+		description["meta"] = meta
+		if cmd.json {
+			data, err := json.Marshal(description)
+			return string(data), err
+		}
+		data, err := json.MarshalIndent(description, "", "  ")
+		return fmt.Sprintf("Drain %s (not added):\n%s\n", name, data), err
+	}
+
+	if err = logyard.AddDrainWithMeta(name, uri, meta); err != nil {
 		return "", err
 	}
 
 	if cmd.json {
-		data, err := json.Marshal(map[string]string{
+		data, err := json.Marshal(map[string]interface{}{
 			"name": name,
-			"uri":  uri})
+			"uri":  uri,
+			"meta": meta})
 		return string(data), err
 	} else {
 		return fmt.Sprintf("Added drain %s: %s\n", name, uri), nil
 	}
 }
+
+// testDrain prints a sample message as formatted by the drain, and
+// attempts to connect to the drain destination.
+func testDrain(cfg *drain.DrainConfig) error {
+	msg, err := drain.SampleMessage(drain.SampleKindFor(cfg), 1)
+	if err != nil {
+		return err
+	}
+	data, err := cfg.FormatJSON(msg)
+	if err != nil {
+		return fmt.Errorf("Unable to format sample message: %s", err)
+	}
+	fmt.Printf("Sample message:\n%s", data)
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		fmt.Println()
+	}
+
+	if err = drain.TestDrainConnection(cfg); err != nil {
+		return fmt.Errorf("Unable to connect to drain %s: %s", cfg.Name, err)
+	}
+	fmt.Printf("Connected to drain %s\n", cfg.Name)
+	return nil
+}
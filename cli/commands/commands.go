@@ -12,5 +12,10 @@ func GetAll() []subcommand.SubCommand {
 		new(list),
 		new(add),
 		new(delete),
+		new(renew),
+		new(restart),
+		new(testdrain),
+		new(export),
+		new(importConfig),
 		new(status)}
 }
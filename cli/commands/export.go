@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"gopkg.in/yaml.v2"
+	"logyard"
+)
+
+// Example:
+//
+//	.. export > drains.yml
+//	.. export -json > drains.json
+type export struct {
+	json bool
+}
+
+func (cmd *export) Name() string {
+	return "export"
+}
+
+func (cmd *export) DefineFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Export as JSON (default: YAML)")
+}
+
+func (cmd *export) Run(args []string) (string, error) {
+	drains := logyard.ExportDrainSet()
+	if cmd.json {
+		data, err := json.MarshalIndent(drains, "", "  ")
+		return string(data) + "\n", err
+	}
+	data, err := yaml.Marshal(drains)
+	return string(data), err
+}
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"logyard"
+	"logyard/drain"
+	"logyard/util/mapdiff"
+	"os"
+)
+
+// Example:
+//
+//	.. import -diff drains.yml
+//	.. import -replace drains.yml
+//	.. export | ssh othernode logyard-cli import -
+type importConfig struct {
+	json    bool
+	replace bool
+	merge   bool
+	diff    bool
+}
+
+func (cmd *importConfig) Name() string {
+	return "import"
+}
+
+func (cmd *importConfig) DefineFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Output result as JSON")
+	fs.BoolVar(&cmd.replace, "replace", false,
+		"Replace the drains, formats and retry limits with those in the file")
+	fs.BoolVar(&cmd.merge, "merge", false,
+		"Add or update the drains, formats and retry limits in the file (default)")
+	fs.BoolVar(&cmd.diff, "diff", false,
+		"Print the changes that would be made, without applying them")
+}
+
+func (cmd *importConfig) Run(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("need exactly one positional argument (file, or - for stdin)")
+	}
+	if cmd.replace && cmd.merge {
+		return "", fmt.Errorf("cannot specify both -replace and -merge")
+	}
+
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// YAML being a superset of JSON, this reads either format.
+	imported := new(logyard.DrainSet)
+	if err = yaml.Unmarshal(data, imported); err != nil {
+		return "", fmt.Errorf("Invalid drain config %s: %s", args[0], err)
+	}
+
+	current := logyard.ExportDrainSet()
+	result := current.Apply(imported, cmd.replace)
+	if err = validateDrainSet(result, imported); err != nil {
+		return "", err
+	}
+	changes := current.Diff(result)
+
+	if !cmd.diff {
+		if err = logyard.ImportDrainSet(imported, cmd.replace); err != nil {
+			return "", err
+		}
+	}
+
+	if cmd.json {
+		data, err := json.Marshal(changes)
+		return string(data), err
+	}
+	count := 0
+	for _, section := range []string{"drainformats", "retrylimits", "drains", "drainmeta"} {
+		for _, change := range changes[section] {
+			printChange(section, change)
+			count++
+		}
+	}
+	if cmd.diff {
+		return fmt.Sprintf("%d changes (not applied)\n", count), nil
+	}
+	return fmt.Sprintf("Applied %d changes\n", count), nil
+}
+
+// validateDrainSet checks the imported drains against the resulting
+// drain formats.
+func validateDrainSet(result, imported *logyard.DrainSet) error {
+	for name, _ := range imported.Drains {
+		uri := result.Drains[name]
+		cfg, err := drain.ParseDrainUri(name, uri, result.DrainFormats)
+		if err != nil {
+			return fmt.Errorf("Invalid drain URI for %s (%s): %s", name, uri, err)
+		}
+		if err = drain.ValidateDrainConfig(cfg); err != nil {
+			return fmt.Errorf("Invalid drain %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func printChange(section string, change mapdiff.MapDiffChange) {
+	switch {
+	case change.Deleted:
+		fmt.Printf("- %s %s\n", section, change.Key)
+	case change.OldValue == "":
+		fmt.Printf("+ %s %s: %s\n", section, change.Key, change.NewValue)
+	default:
+		fmt.Printf("~ %s %s: %s -> %s\n",
+			section, change.Key, change.OldValue, change.NewValue)
+	}
+}
@@ -6,10 +6,18 @@ import (
 	"fmt"
 	"logyard"
 	"sort"
+	"time"
 )
 
 type list struct {
 	json bool
+	meta bool
+}
+
+// drainInfo is a drain as output by `list -json -meta`.
+type drainInfo struct {
+	URI string `json:"uri"`
+	logyard.DrainMeta
 }
 
 func (cmd *list) Name() string {
@@ -18,22 +26,73 @@ func (cmd *list) Name() string {
 
 func (cmd *list) DefineFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&cmd.json, "json", false, "Output result as JSON")
+	fs.BoolVar(&cmd.meta, "meta", false,
+		"Include drain metadata (description, owner, labels, ...)")
 }
 
 func (cmd *list) Run(args []string) (string, error) {
 	config := logyard.GetConfig()
+	var leases *logyard.DrainLeases
+	if cmd.meta {
+		leases = drainLeases()
+	}
 	if cmd.json {
-		data, err := json.Marshal(config.Drains)
+		if !cmd.meta {
+			data, err := json.Marshal(config.Drains)
+			return string(data), err
+		}
+		drains := make(map[string]drainInfo)
+		for name, uri := range config.Drains {
+			meta, err := leases.Meta(name)
+			if err != nil {
+				return "", err
+			}
+			drains[name] = drainInfo{uri, meta}
+		}
+		data, err := json.Marshal(drains)
 		return string(data), err
 	} else {
 		for _, name := range sortedKeysStringMap(config.Drains) {
 			uri := config.Drains[name]
 			fmt.Printf("%-20s\t%s\n", name, uri)
+			if cmd.meta {
+				meta, err := leases.Meta(name)
+				if err != nil {
+					return "", err
+				}
+				printDrainMeta(meta)
+			}
 		}
 		return "", nil
 	}
 }
 
+func printDrainMeta(meta logyard.DrainMeta) {
+	if meta.Description != "" {
+		fmt.Printf("\t%s\n", meta.Description)
+	}
+	if meta.Owner != "" {
+		fmt.Printf("\towner: %s\n", meta.Owner)
+	}
+	for _, key := range sortedKeysStringMap(meta.Labels) {
+		fmt.Printf("\tlabel: %s=%s\n", key, meta.Labels[key])
+	}
+	if meta.Created != 0 {
+		fmt.Printf("\tcreated: %s", time.Unix(meta.Created, 0).Format(time.RFC3339))
+		if meta.CreatedBy != "" {
+			fmt.Printf(" on %s", meta.CreatedBy)
+		}
+		fmt.Println()
+	}
+	if meta.Expires != 0 {
+		fmt.Printf("\texpires: %s (ttl %s)\n",
+			time.Unix(meta.Expires, 0).Format(time.RFC3339), meta.TTL)
+	}
+	if meta.Updated != 0 && meta.Updated != meta.Created {
+		fmt.Printf("\tupdated: %s\n", time.Unix(meta.Updated, 0).Format(time.RFC3339))
+	}
+}
+
 func sortedKeysStringMap(m map[string]string) []string {
 	keys := make([]string, len(m))
 	idx := 0
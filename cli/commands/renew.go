@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/hpcloud/stackato-go/server"
+	"logyard"
+	"time"
+)
+
+// Example:
+//
+//	.. renew -ttl 2h mydrain
+type renew struct {
+	json bool
+	ttl  time.Duration
+}
+
+func (cmd *renew) Name() string {
+	return "renew"
+}
+
+func (cmd *renew) DefineFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Output result as JSON")
+	fs.DurationVar(&cmd.ttl, "ttl", 0,
+		"Renew the lease for this long (default: the drain's ttl)")
+}
+
+func (cmd *renew) Run(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("need at least one positional argument")
+	}
+	if cmd.ttl < 0 {
+		return "", fmt.Errorf("ttl must be positive")
+	}
+	leases := drainLeases()
+	for _, name := range args {
+		if err := leases.Renew(name, cmd.ttl); err != nil {
+			return "", err
+		}
+		if !cmd.json {
+			fmt.Printf("Renewed the lease of drain %s\n", name)
+		}
+	}
+	if cmd.json {
+		return "{}", nil
+	} else {
+		return "", nil
+	}
+}
+
+// drainLeases returns the store of drain lease renewals, in applog
+// redis.
+func drainLeases() *logyard.DrainLeases {
+	return &logyard.DrainLeases{
+		Prefix: logyard.DRAIN_LEASE_PREFIX,
+		Client: server.NewRedisClientMust(
+			server.GetClusterConfig().MbusIp+":6464",
+			"",
+			0)}
+}
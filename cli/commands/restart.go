@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"logyard/drain"
+)
+
+// Restart drains running on this node, eg: those that went FATAL
+// after exhausting their retry limit.
+//
+// Example:
+//
+//	.. restart mydrain
+//	.. restart -state FATAL
+type restart struct {
+	json   bool
+	state  string
+	socket string
+}
+
+func (cmd *restart) Name() string {
+	return "restart"
+}
+
+func (cmd *restart) DefineFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Output result as JSON")
+	fs.StringVar(&cmd.state, "state", "",
+		"Restart only drains in this state (eg: FATAL); all drains if no names are given")
+	fs.StringVar(&cmd.socket, "socket", drain.CONTROL_SOCKET,
+		"Control socket of the local logyard daemon")
+}
+
+func (cmd *restart) Run(args []string) (string, error) {
+	if len(args) == 0 && cmd.state == "" {
+		return "", fmt.Errorf("need drain names, or -state")
+	}
+	restarted, err := drain.RestartDrains(cmd.socket, args, cmd.state)
+	if err != nil {
+		return "", err
+	}
+	if cmd.json {
+		data, err := json.Marshal(restarted)
+		return string(data), err
+	}
+	if len(restarted) == 0 {
+		return "No drains restarted\n", nil
+	}
+	for _, name := range restarted {
+		fmt.Printf("Restarted drain %s\n", name)
+	}
+	return "", nil
+}
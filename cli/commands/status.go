@@ -7,16 +7,29 @@ import (
 	"github.com/hpcloud/golor"
 	"github.com/hpcloud/stackato-go/server"
 	"logyard"
+	"logyard/drain"
 	"logyard/util/statecache"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type status struct {
 	json       bool
 	prefix     bool
 	notrunning bool
+	meta       bool
+	local      bool
+	socket     string
+}
+
+// drainStatus is a drain as output by `status -json -meta`.
+type drainStatus struct {
+	Meta      logyard.DrainMeta               `json:"meta"`
+	Placement string                          `json:"placement"`
+	Leader    *drain.LeaderInfo               `json:"leader,omitempty"`
+	States    map[string]statecache.StateInfo `json:"states"`
 }
 
 func (cmd *status) Name() string {
@@ -30,6 +43,12 @@ func (cmd *status) DefineFlags(fs *flag.FlagSet) {
 		"Treat drain names as prefix")
 	fs.BoolVar(&cmd.notrunning, "notrunning", false,
 		"show only drains not running")
+	fs.BoolVar(&cmd.meta, "meta", false,
+		"Include drain metadata (description, owner, labels, ...)")
+	fs.BoolVar(&cmd.local, "local", false,
+		"Query the live state of drains from the local logyard daemon")
+	fs.StringVar(&cmd.socket, "socket", drain.CONTROL_SOCKET,
+		"Control socket of the local logyard daemon (with -local)")
 }
 
 func (cmd *status) GetDrains(args []string) ([]string, error) {
@@ -59,6 +78,9 @@ func (cmd *status) GetDrains(args []string) ([]string, error) {
 }
 
 func (cmd *status) Run(args []string) (string, error) {
+	if cmd.local {
+		return cmd.runLocal(args)
+	}
 	cache := &statecache.StateCache{
 		"logyard:drainstatus:",
 		server.LocalIPMust(),
@@ -72,6 +94,10 @@ func (cmd *status) Run(args []string) (string, error) {
 		return "", err
 	}
 	data := make(map[string]map[string]statecache.StateInfo)
+	elector := &drain.Elector{Prefix: "logyard:drainleader:", Client: cache.Client}
+	leaders := make(map[string]*drain.LeaderInfo)
+	leases := &logyard.DrainLeases{Prefix: logyard.DRAIN_LEASE_PREFIX, Client: cache.Client}
+	metas := make(map[string]logyard.DrainMeta)
 
 	for _, name := range drains {
 		states, err := cache.GetState(name)
@@ -79,26 +105,107 @@ func (cmd *status) Run(args []string) (string, error) {
 			return "", fmt.Errorf("Unable to retrieve cached state: %v", err)
 		}
 		data[name] = states
+		if drainPlacement(name).Kind == drain.PLACEMENT_ONE {
+			if leaders[name], err = elector.Info(name); err != nil {
+				return "", fmt.Errorf("Unable to retrieve drain leader: %v", err)
+			}
+		}
+		if cmd.meta {
+			if metas[name], err = leases.Meta(name); err != nil {
+				return "", fmt.Errorf("Unable to retrieve drain lease: %v", err)
+			}
+		}
 	}
 
 	if cmd.json {
-		b, err := json.Marshal(data)
+		if !cmd.meta {
+			b, err := json.Marshal(data)
+			return string(b), err
+		}
+		drains := make(map[string]drainStatus)
+		for name, states := range data {
+			drains[name] = drainStatus{
+				metas[name], drainPlacement(name).String(),
+				leaders[name], states}
+		}
+		b, err := json.Marshal(drains)
 		return string(b), err
 	} else {
 		for name, states := range data {
+			printed := false
 			for _, nodeip := range sortedKeysStateMap(states) {
 				running := strings.Contains(states[nodeip]["name"], "RUNNING")
 				if cmd.notrunning && running {
 					continue
 				}
-				printStatus(name, nodeip, states[nodeip])
+				printStatus(name, nodeip, states[nodeip], drainPlacement(name))
+				printed = true
+			}
+			if leader := leaders[name]; leader != nil && printed {
+				printLeader(leader)
+			}
+			if cmd.meta && printed {
+				printDrainMeta(metas[name])
 			}
 		}
 		return "", nil
 	}
 }
 
-func printStatus(name, nodeip string, info statecache.StateInfo) error {
+// runLocal shows the drains running on this node, as reported by the
+// logyard daemon itself rather than the state cached in redis.
+func (cmd *status) runLocal(args []string) (string, error) {
+	if cmd.prefix && len(args) != 1 {
+		return "", fmt.Errorf("Need exactly 1 position arg")
+	}
+	var names []string
+	if !cmd.prefix {
+		names = args
+	}
+	infos, err := drain.QueryDrains(cmd.socket, names)
+	if err != nil {
+		return "", err
+	}
+	var selected []drain.DrainInfo
+	for _, info := range infos {
+		if cmd.prefix && !strings.HasPrefix(info.Name, args[0]) {
+			continue
+		}
+		if cmd.notrunning && info.State == "RUNNING" {
+			continue
+		}
+		selected = append(selected, info)
+	}
+
+	if cmd.json {
+		b, err := json.Marshal(selected)
+		return string(b), err
+	}
+	for _, info := range selected {
+		fmt.Printf("%-20s\t%s[%d]", info.Name, info.State, info.Rev)
+		if info.State == "RUNNING" {
+			fmt.Printf("\tup %v", time.Duration(info.Uptime)*time.Second)
+		}
+		if info.Error != "" {
+			fmt.Printf("\t%s", golor.Colorize(info.Error, golor.RGB(5, 0, 0), -1))
+		}
+		fmt.Println()
+	}
+	return "", nil
+}
+
+// drainPlacement returns the placement of the drain, defaulting to
+// all nodes for unknown or invalid drains.
+func drainPlacement(name string) drain.Placement {
+	placement, err := drain.DrainPlacement(logyard.GetConfig().Drains[name])
+	if err != nil {
+		return drain.Placement{Kind: drain.PLACEMENT_ALL}
+	}
+	return placement
+}
+
+func printStatus(
+	name, nodeip string, info statecache.StateInfo, placement drain.Placement) error {
 	rev, err := strconv.Atoi(info["rev"])
 	if err != nil {
 		return fmt.Errorf("Corrupt drain status: %v", err)
@@ -106,6 +213,9 @@ func printStatus(name, nodeip string, info statecache.StateInfo) error {
 	state := info["name"]
 
 	fmt.Printf("%-20s\t%s\t%s[%d]", name, nodeip, state, rev)
+	if placement.Kind != drain.PLACEMENT_ALL {
+		fmt.Printf("\tplacement=%s", placement)
+	}
 	if error, ok := info["error"]; ok {
 		fmt.Printf("\t%s", golor.Colorize(error, golor.RGB(5, 0, 0), -1))
 	}
@@ -113,6 +223,20 @@ func printStatus(name, nodeip string, info statecache.StateInfo) error {
 	return nil
 }
 
+func printLeader(info *drain.LeaderInfo) {
+	if info.Leader == "" {
+		fmt.Printf("\tleader: none (%s resigned)\n", info.Previous)
+		return
+	}
+	since := time.Unix(0, info.Since*int64(time.Millisecond))
+	fmt.Printf("\tleader: %s since %s", info.Leader, since.Format(time.RFC3339))
+	if info.Previous != "" {
+		fmt.Printf(" (took over from %s after %v)", info.Previous,
+			time.Duration(info.Failover)*time.Millisecond)
+	}
+	fmt.Println()
+}
+
 func sortedKeysStateMap(m map[string]statecache.StateInfo) []string {
 	keys := make([]string, len(m))
 	idx := 0
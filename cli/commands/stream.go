@@ -17,12 +17,18 @@ import (
 
 const CLI_STREAM_PROTO = "tcp"
 
+// The stream drain is leased for CLI_STREAM_LEASE, and renewed
+// thrice as often, so that it gets deleted soon after the CLI is
+// killed without a chance to delete it.
+const CLI_STREAM_LEASE = time.Minute
+
 type stream struct {
-	json    bool
-	raw     bool
-	time    bool
-	nocolor bool
-	nodeid  string
+	json      bool
+	raw       bool
+	time      bool
+	nocolor   bool
+	nodeid    string
+	multiline string
 }
 
 func (cmd *stream) Name() string {
@@ -39,9 +45,21 @@ func (cmd *stream) DefineFlags(fs *flag.FlagSet) {
 		"Output with no colors")
 	fs.StringVar(&cmd.nodeid, "nodeid", "",
 		"Filter by this node IP address")
+	fs.StringVar(&cmd.multiline, "multiline", "",
+		"Join multi-line messages (eg: stack traces); a preset "+
+			"(indented, java, python) or a continuation line regexp")
 }
 
 func (cmd *stream) Run(args []string) (string, error) {
+	var stages []drain.Stage
+	if cmd.multiline != "" {
+		multiline, err := drain.NewMultilinePreset(cmd.multiline)
+		if err != nil {
+			return "", err
+		}
+		stages = append(stages, multiline)
+	}
+
 	ipaddr, err := server.LocalIP()
 	if err != nil {
 		return "", err
@@ -80,11 +98,17 @@ func (cmd *stream) Run(args []string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if err = logyard.AddDrain(name, uri); err != nil {
+	meta := &logyard.DrainMeta{
+		Description: "logyard-cli stream",
+		Owner:       os.Getenv("USER"),
+		TTL:         CLI_STREAM_LEASE.String()}
+	if err = logyard.AddDrainWithMeta(name, uri, meta); err != nil {
 		return "", err
 	}
 	log.Infof("Added drain %s", uri)
 
+	go renewLease(name, CLI_STREAM_LEASE)
+
 	deleteDrain := func() {
 		if err := logyard.DeleteDrain(name); err != nil {
 			log.Fatal(err)
@@ -100,11 +124,23 @@ func (cmd *stream) Run(args []string) (string, error) {
 	})
 
 	cli_stream.Stream(srv.Ch, cli_stream.MessagePrinterOptions{
-		cmd.raw, cmd.raw || debugMode, cmd.time, cmd.nocolor, cmd.nodeid, cmd.json})
+		cmd.raw, cmd.raw || debugMode, cmd.time, cmd.nocolor, cmd.nodeid, cmd.json},
+		stages)
 
 	return "", nil
 }
 
+// renewLease periodically renews the lease of the drain, for as long
+// as the CLI runs.
+func renewLease(name string, ttl time.Duration) {
+	leases := drainLeases()
+	for _ = range time.Tick(ttl / 3) {
+		if err := leases.Renew(name, ttl); err != nil {
+			log.Errorf("Unable to renew the lease of drain %s: %v", name, err)
+		}
+	}
+}
+
 func handleKeyboardInterrupt(cleanupFn func()) {
 	// Handle Ctrl+C
 	sigCh := make(chan os.Signal, 1)
@@ -0,0 +1,236 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hpcloud/zmqpubsub"
+	"logyard/drain"
+	"os"
+	"strings"
+	"time"
+)
+
+// Example:
+//
+//	.. test-drain -uri udp://logs.papertrailapp.com:12345 -kind apptail -n 5
+//	.. test-drain -uri tcp://localhost:5000 -stdin < records.txt
+type testdrain struct {
+	json    bool
+	uri     string
+	filters Filters
+	params  Options
+	kind    string
+	count   int
+	stdin   bool
+	timeout time.Duration
+}
+
+// testResult is the outcome of sending a single message.
+type testResult struct {
+	Key     string  `json:"key"`
+	Success bool    `json:"success"`
+	Latency float64 `json:"latency_ms"`
+	Data    string  `json:"data,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+func (cmd *testdrain) Name() string {
+	return "test-drain"
+}
+
+func (cmd *testdrain) DefineFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Output result as JSON")
+	fs.StringVar(&cmd.uri, "uri", "", "Drain URI (eg: udp://logs.loggly.com:12345)")
+	fs.Var(&cmd.filters, "filter", "Message filter (selects the default -kind)")
+	cmd.params = make(map[string]string)
+	fs.Var(&cmd.params, "o", "Drain options (eg: -o 'limit=100' or -o 'format={{.Text}}'")
+	fs.StringVar(&cmd.kind, "kind", "",
+		"Kind of sample messages: systail, apptail or event")
+	fs.IntVar(&cmd.count, "n", 3, "Number of sample messages to send")
+	fs.BoolVar(&cmd.stdin, "stdin", false,
+		"Send records read from stdin (one `[key] json` per line) instead of samples")
+	fs.DurationVar(&cmd.timeout, "timeout", 10*time.Second,
+		"Time to wait for the drain to connect, and for each message to be sent")
+}
+
+func (cmd *testdrain) Run(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("need at most one positional argument")
+	}
+	name := "test-drain"
+	if len(args) == 1 {
+		name = args[0]
+	}
+
+	uri, err := drain.ConstructDrainURI(name, cmd.uri, cmd.filters, cmd.params)
+	if err != nil {
+		return "", err
+	}
+	cfg, err := drain.NewDrainConfig(name, uri)
+	if err != nil {
+		return "", err
+	}
+	if err = drain.ValidateDrainConfig(cfg); err != nil {
+		return "", fmt.Errorf("Invalid drain %s: %s", name, err)
+	}
+
+	msgs, err := cmd.messages(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// The drain is fed directly, rather than from the logyard
+	// broker, and reports every write back to us. There is a slot
+	// per message; further traces (eg: of dedupe summaries) are
+	// dropped rather than block the drain.
+	traceCh := make(chan traced, len(msgs))
+	cfg.Source = make(chan zmqpubsub.Message)
+	cfg.Trace = func(msg zmqpubsub.Message, data []byte, err error) {
+		select {
+		case traceCh <- traced{msg, data, err}:
+		default:
+		}
+	}
+
+	d := drain.DRAINS[cfg.Type](name)
+	go d.Start(cfg)
+	if !waitRunning(d, cmd.timeout) {
+		return "", fmt.Errorf("Drain %s failed to start: %v", name, d.Stop())
+	}
+	defer d.Stop()
+
+	var results []testResult
+	for _, msg := range msgs {
+		result := testResult{Key: msg.Key}
+		start := time.Now()
+		select {
+		case cfg.Source <- msg:
+			if t, ok := awaitTrace(traceCh, msg, cmd.timeout); ok {
+				result.Data = string(t.data)
+				if t.err != nil {
+					result.Error = t.err.Error()
+				}
+			} else {
+				// Stages (eg: dedupe, multiline) may hold on to
+				// the message.
+				result.Error = fmt.Sprintf("not sent within %v", cmd.timeout)
+			}
+		case <-time.After(cmd.timeout):
+			result.Error = fmt.Sprintf("drain did not accept message within %v", cmd.timeout)
+		}
+		result.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+		result.Success = result.Error == ""
+		results = append(results, result)
+		if !cmd.json {
+			printTestResult(len(results), result)
+		}
+		if !result.Success {
+			// the drain exits on write errors.
+			break
+		}
+	}
+
+	if cmd.json {
+		data, err := json.Marshal(results)
+		return string(data), err
+	}
+	if n := len(results); n > 0 && !results[n-1].Success {
+		return "", fmt.Errorf("Failed to send message %d of %d", n, len(msgs))
+	}
+	return fmt.Sprintf("Sent %d messages to drain %s\n", len(results), name), nil
+}
+
+// messages returns the messages to send, either samples or records
+// read from stdin.
+func (cmd *testdrain) messages(cfg *drain.DrainConfig) ([]zmqpubsub.Message, error) {
+	kind := cmd.kind
+	if kind == "" {
+		kind = drain.SampleKindFor(cfg)
+	}
+	var msgs []zmqpubsub.Message
+
+	if !cmd.stdin {
+		for i := 1; i <= cmd.count; i++ {
+			msg, err := drain.SampleMessage(kind, i)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+		}
+		return msgs, nil
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// Lines are either "<key> <json>", as printed by `recv`, or
+		// just the json record.
+		key := kind + ".stdin"
+		if !strings.HasPrefix(line, "{") {
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid record: %s", line)
+			}
+			key, line = parts[0], parts[1]
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("invalid record (%s): %s", err, line)
+		}
+		msgs = append(msgs, zmqpubsub.Message{Key: key, Value: line})
+	}
+	return msgs, scanner.Err()
+}
+
+// traced is a write reported by the drain being tested.
+type traced struct {
+	msg  zmqpubsub.Message
+	data []byte
+	err  error
+}
+
+// awaitTrace waits for the write of msg to be reported, skipping the
+// traces of earlier messages that stages released late (or merged).
+func awaitTrace(
+	traceCh chan traced, msg zmqpubsub.Message, timeout time.Duration) (traced, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case t := <-traceCh:
+			if t.msg == msg {
+				return t, true
+			}
+		case <-deadline:
+			return traced{}, false
+		}
+	}
+}
+
+func waitRunning(d drain.DrainType, timeout time.Duration) bool {
+	ch := make(chan bool, 1)
+	go func() { ch <- d.WaitRunning() }()
+	select {
+	case running := <-ch:
+		return running
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func printTestResult(n int, result testResult) {
+	if result.Success {
+		fmt.Printf("#%d %s: sent in %.1fms (%d bytes)\n",
+			n, result.Key, result.Latency, len(result.Data))
+	} else {
+		fmt.Printf("#%d %s: FAILED after %.1fms -- %s\n",
+			n, result.Key, result.Latency, result.Error)
+	}
+	if result.Data != "" {
+		fmt.Printf("  %q\n", result.Data)
+	}
+}
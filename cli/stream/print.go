@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/hpcloud/golor"
 	"github.com/hpcloud/zmqpubsub"
+	"logyard/util/templatefuncs"
 	"strings"
 	"text/template"
 	"time"
@@ -49,7 +50,7 @@ func (p MessagePrinter) AddFormat(keypart1 string, format string) {
 		panic("already added")
 	}
 	p.templates[keypart1] = template.Must(
-		template.New("print-" + keypart1).Parse(format))
+		templatefuncs.New("print-" + keypart1).Parse(format))
 }
 
 func (p *MessagePrinter) SetPrePrintHook(fn FilterFn) {
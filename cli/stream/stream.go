@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"github.com/hpcloud/log"
 	"github.com/hpcloud/zmqpubsub"
+	"logyard/drain"
 	"strings"
+	"time"
 )
 
-func Stream(ch chan string, options MessagePrinterOptions) {
+// Stream prints the "<key> <json>" lines received on ch, after passing
+// them through the given drain stages (eg: multiline aggregation).
+func Stream(ch chan string, options MessagePrinterOptions, stages []drain.Stage) {
 	// XXX: do we need MessagePrinter at all? all it does is
 	// provide abstraction over color formatting; most other things
 	// (formatting, skipping) happen in handler.go.
@@ -22,26 +26,51 @@ func Stream(ch chan string, options MessagePrinterOptions) {
 
 	printer.SetPrePrintHook(streamHandler)
 
-	// Print incoming records
-	for line := range ch {
-		parts := strings.SplitN(string(line), " ", 2)
-		if len(parts) != 2 {
-			printer.PrintInternalError(fmt.Sprintf(
-				"received invalid message: %v", string(line)))
-			continue
-		}
-		msg := zmqpubsub.Message{parts[0], parts[1]}
-		if !(strings.HasPrefix(msg.Key, "systail") ||
-			strings.HasPrefix(msg.Key, "apptail") ||
-			strings.HasPrefix(msg.Key, "event")) {
-			printer.PrintInternalError(fmt.Sprintf(
-				"unsupported stream key (%s) for message: %v",
-				msg.Key, msg.Value))
-			continue
+	printAll := func(msgs []zmqpubsub.Message) {
+		for _, msg := range msgs {
+			if err := printer.Print(msg); err != nil {
+				log.Fatalf("Error -- %s -- printing message %s:%s",
+					err, msg.Key, msg.Value)
+			}
 		}
-		if err := printer.Print(msg); err != nil {
-			log.Fatalf("Error -- %s -- printing message %s:%s",
-				err, msg.Key, msg.Value)
+	}
+
+	var tick <-chan time.Time
+	if len(stages) > 0 {
+		ticker := time.NewTicker(drain.STAGE_TICK)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// Print incoming records
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				// Print the messages still held back by the stages
+				// (eg: the tail of a stack trace).
+				printAll(drain.FlushStages(stages, time.Now()))
+				return
+			}
+			parts := strings.SplitN(string(line), " ", 2)
+			if len(parts) != 2 {
+				printer.PrintInternalError(fmt.Sprintf(
+					"received invalid message: %v", string(line)))
+				continue
+			}
+			msg := zmqpubsub.Message{parts[0], parts[1]}
+			if !(strings.HasPrefix(msg.Key, "systail") ||
+				strings.HasPrefix(msg.Key, "apptail") ||
+				strings.HasPrefix(msg.Key, "event")) {
+				printer.PrintInternalError(fmt.Sprintf(
+					"unsupported stream key (%s) for message: %v",
+					msg.Key, msg.Value))
+				continue
+			}
+			printAll(drain.RunStages(
+				stages, []zmqpubsub.Message{msg}, time.Now()))
+		case now := <-tick:
+			printAll(drain.TickStages(stages, now))
 		}
 	}
 }
@@ -10,8 +10,26 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 )
 
+const DEFAULT_FLUSH_TIMEOUT = 10 * time.Second
+
+// flushTimeout returns how long drains may take to flush on shutdown.
+func flushTimeout() time.Duration {
+	value := logyard.GetConfig().FlushTimeout
+	if value == "" {
+		return DEFAULT_FLUSH_TIMEOUT
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		log.Errorf("Invalid flushtimeout (%s) -- %v -- using default value (%v)",
+			value, err, DEFAULT_FLUSH_TIMEOUT)
+		return DEFAULT_FLUSH_TIMEOUT
+	}
+	return timeout
+}
+
 func main() {
 	major, minor, patch := gozmq.Version()
 	log.Infof("Starting logyard (Go %s; ZeroMQ %d.%d.%d)",
@@ -20,13 +38,18 @@ func main() {
 	m := drain.NewDrainManager()
 	log.Info("Starting drain manager")
 	go m.Run()
+	go func() {
+		if err := m.ServeControl(drain.CONTROL_SOCKET); err != nil {
+			log.Errorf("Unable to serve drain control requests: %v", err)
+		}
+	}()
 	// SIGTERM handle for stopping running drains.
 	go func() {
 		sigchan := make(chan os.Signal)
 		signal.Notify(sigchan, syscall.SIGTERM)
 		<-sigchan
-		log.Info("Stopping all drains before exiting")
-		m.Stop()
+		log.Info("Flushing and stopping all drains before exiting")
+		m.Shutdown(flushTimeout())
 		log.Info("Exiting now.")
 		os.Exit(0)
 	}()
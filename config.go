@@ -1,15 +1,49 @@
 package logyard
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/hpcloud/log"
 	"github.com/hpcloud/stackato-go/server"
+	"logyard/util/mapdiff"
+	"os"
 	"sync"
+	"time"
 )
 
 type logyardConfig struct {
 	RetryLimits  map[string]string `json:"retrylimits"`
 	DrainFormats map[string]string `json:"drainformats"`
 	Drains       map[string]string `json:"drains"`
+	RedactRules  map[string]string `json:"redactrules"`
+	Redact       []string          `json:"redact"`
+	// How long drains may take to write out their queued messages
+	// when logyard is stopped (eg: 10s).
+	FlushTimeout string `json:"flushtimeout"`
+	// Roles of the nodes, by node IP, for drains placed by role.
+	NodeRoles map[string][]string `json:"noderoles"`
+	// Optional metadata of the drains in Drains, by drain name.
+	DrainMeta map[string]DrainMeta `json:"drainmeta"`
+}
+
+// DrainMeta is the descriptive metadata of a drain. Drains added
+// before metadata was introduced simply have none.
+type DrainMeta struct {
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Created     int64             `json:"created,omitempty" yaml:"created,omitempty"` // unix time
+	Updated     int64             `json:"updated,omitempty" yaml:"updated,omitempty"` // unix time
+	CreatedBy   string            `json:"created_by,omitempty" yaml:"created_by,omitempty"`
+	// Drains with a lease (TTL) are deleted by the drain manager
+	// once it expires, unless it was renewed by their creator.
+	TTL     string `json:"ttl,omitempty" yaml:"ttl,omitempty"`         // eg: 1h
+	Expires int64  `json:"expires,omitempty" yaml:"expires,omitempty"` // unix time
+}
+
+// Expired returns true if the drain's lease expired by now.
+func (m DrainMeta) Expired(now time.Time) bool {
+	return m.Expires != 0 && now.Unix() >= m.Expires
 }
 
 var config *server.Config
@@ -31,16 +65,155 @@ func DeleteDrain(name string) error {
 	return config.AtomicSave(func(i interface{}) error {
 		config := i.(*logyardConfig)
 		delete(config.Drains, name)
+		delete(config.DrainMeta, name)
 		return nil
 	})
 }
 
 // AddDrain adds a drain to the config.
 func AddDrain(name, uri string) error {
+	return AddDrainWithMeta(name, uri, nil)
+}
+
+// AddDrainWithMeta adds (or updates) a drain in the config, along
+// with its metadata (if not nil). The created/updated times and the
+// creating host are filled in, as is the lease expiry time if a TTL
+// is given.
+func AddDrainWithMeta(name, uri string, meta *DrainMeta) error {
 	once.Do(createLogyardConfig)
+	var m DrainMeta
+	if meta != nil {
+		m = *meta
+	}
+	now := time.Now().Unix()
+	m.Updated = now
+	if m.TTL != "" {
+		ttl, err := time.ParseDuration(m.TTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid drain ttl: %s", m.TTL)
+		}
+		m.Expires = now + int64(ttl/time.Second)
+	}
 	return config.AtomicSave(func(i interface{}) error {
 		config := i.(*logyardConfig)
+		if old, ok := config.DrainMeta[name]; ok && old.Created != 0 {
+			if _, exists := config.Drains[name]; exists {
+				m.Created, m.CreatedBy = old.Created, old.CreatedBy
+			}
+		}
+		if m.Created == 0 {
+			m.Created = now
+			m.CreatedBy, _ = os.Hostname()
+		}
 		config.Drains[name] = uri
+		if config.DrainMeta == nil {
+			config.DrainMeta = make(map[string]DrainMeta)
+		}
+		config.DrainMeta[name] = m
+		return nil
+	})
+}
+
+// GetDrainMeta returns the metadata of the drain, which is empty for
+// drains added without any.
+func GetDrainMeta(name string) DrainMeta {
+	return GetConfig().DrainMeta[name]
+}
+
+// DrainSet is the part of the logyard config that can be exported
+// and imported: the drains, their metadata, and the formats and retry
+// limits they refer to.
+type DrainSet struct {
+	Drains       map[string]string    `json:"drains,omitempty" yaml:"drains,omitempty"`
+	DrainMeta    map[string]DrainMeta `json:"drainmeta,omitempty" yaml:"drainmeta,omitempty"`
+	DrainFormats map[string]string    `json:"drainformats,omitempty" yaml:"drainformats,omitempty"`
+	RetryLimits  map[string]string    `json:"retrylimits,omitempty" yaml:"retrylimits,omitempty"`
+}
+
+func (c *logyardConfig) drainSet() *DrainSet {
+	return &DrainSet{
+		Drains:       c.Drains,
+		DrainMeta:    c.DrainMeta,
+		DrainFormats: c.DrainFormats,
+		RetryLimits:  c.RetryLimits}
+}
+
+// ExportDrainSet returns the current drain set.
+func ExportDrainSet() *DrainSet {
+	return GetConfig().drainSet()
+}
+
+// Apply returns the result of importing the imported drain set into
+// s. In replace mode, each section present in imported replaces that
+// of s; otherwise the entries of imported are merged into s. Sections
+// absent from imported are left unchanged in both modes.
+func (s *DrainSet) Apply(imported *DrainSet, replace bool) *DrainSet {
+	result := &DrainSet{
+		Drains:       applySection(s.Drains, imported.Drains, replace),
+		DrainMeta:    make(map[string]DrainMeta),
+		DrainFormats: applySection(s.DrainFormats, imported.DrainFormats, replace),
+		RetryLimits:  applySection(s.RetryLimits, imported.RetryLimits, replace)}
+	if imported.DrainMeta == nil || !replace {
+		for name, meta := range s.DrainMeta {
+			result.DrainMeta[name] = meta
+		}
+	}
+	for name, meta := range imported.DrainMeta {
+		result.DrainMeta[name] = meta
+	}
+	// Metadata of drains that no longer exist is dropped.
+	for name, _ := range result.DrainMeta {
+		if _, ok := result.Drains[name]; !ok {
+			delete(result.DrainMeta, name)
+		}
+	}
+	return result
+}
+
+// Diff returns the changes, per section, from s to other.
+func (s *DrainSet) Diff(other *DrainSet) map[string][]mapdiff.MapDiffChange {
+	return map[string][]mapdiff.MapDiffChange{
+		"drains":       mapdiff.MapDiff(s.Drains, other.Drains),
+		"drainmeta":    mapdiff.MapDiff(metaStrings(s.DrainMeta), metaStrings(other.DrainMeta)),
+		"drainformats": mapdiff.MapDiff(s.DrainFormats, other.DrainFormats),
+		"retrylimits":  mapdiff.MapDiff(s.RetryLimits, other.RetryLimits)}
+}
+
+// metaStrings returns the metadata encoded as JSON strings, for use
+// with mapdiff.
+func metaStrings(meta map[string]DrainMeta) map[string]string {
+	m := make(map[string]string)
+	for name, v := range meta {
+		data, _ := json.Marshal(v)
+		m[name] = string(data)
+	}
+	return m
+}
+
+func applySection(current, imported map[string]string, replace bool) map[string]string {
+	result := make(map[string]string)
+	if imported == nil || !replace {
+		for k, v := range current {
+			result[k] = v
+		}
+	}
+	for k, v := range imported {
+		result[k] = v
+	}
+	return result
+}
+
+// ImportDrainSet imports the drain set into the config (see
+// DrainSet.Apply).
+func ImportDrainSet(imported *DrainSet, replace bool) error {
+	once.Do(createLogyardConfig)
+	return config.AtomicSave(func(i interface{}) error {
+		config := i.(*logyardConfig)
+		result := config.drainSet().Apply(imported, replace)
+		config.Drains = result.Drains
+		config.DrainMeta = result.DrainMeta
+		config.DrainFormats = result.DrainFormats
+		config.RetryLimits = result.RetryLimits
 		return nil
 	})
 }
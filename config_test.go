@@ -0,0 +1,75 @@
+package logyard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainSetApply(t *testing.T) {
+	current := &DrainSet{
+		Drains:       map[string]string{"a": "udp://a:1", "b": "udp://b:1"},
+		DrainFormats: map[string]string{"systail": "{{.text}}"}}
+	imported := &DrainSet{
+		Drains: map[string]string{"b": "udp://b:2", "c": "udp://c:1"}}
+
+	merged := current.Apply(imported, false)
+	if len(merged.Drains) != 3 || merged.Drains["b"] != "udp://b:2" {
+		t.Fatalf("unexpected merged drains: %v", merged.Drains)
+	}
+	replaced := current.Apply(imported, true)
+	if _, ok := replaced.Drains["a"]; ok || len(replaced.Drains) != 2 {
+		t.Fatalf("unexpected replaced drains: %v", replaced.Drains)
+	}
+	// sections absent from the imported set are left alone.
+	if replaced.DrainFormats["systail"] != "{{.text}}" {
+		t.Fatalf("drainformats were not retained: %v", replaced.DrainFormats)
+	}
+
+	changes := current.Diff(replaced)["drains"]
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes; got %+v", changes)
+	}
+	if !changes[0].Deleted || changes[0].Key != "a" {
+		t.Fatalf("expected drain a to be deleted; got %+v", changes[0])
+	}
+	if changes[1].Key != "b" || changes[1].OldValue != "udp://b:1" {
+		t.Fatalf("expected drain b to be changed; got %+v", changes[1])
+	}
+	if len(current.Diff(replaced)["drainformats"]) != 0 {
+		t.Fatal("expected no changes to drainformats")
+	}
+}
+
+func TestDrainSetApplyMeta(t *testing.T) {
+	current := &DrainSet{
+		Drains:    map[string]string{"a": "udp://a:1", "b": "udp://b:1"},
+		DrainMeta: map[string]DrainMeta{"a": {Owner: "ops"}, "b": {Owner: "dev"}}}
+	imported := &DrainSet{
+		Drains:    map[string]string{"b": "udp://b:2"},
+		DrainMeta: map[string]DrainMeta{"b": {Owner: "qa"}}}
+
+	result := current.Apply(imported, true)
+	if _, ok := result.DrainMeta["a"]; ok {
+		t.Fatal("expected the metadata of the removed drain a to be dropped")
+	}
+	if result.DrainMeta["b"].Owner != "qa" {
+		t.Fatalf("unexpected metadata of b: %+v", result.DrainMeta["b"])
+	}
+	if changes := current.Diff(result)["drainmeta"]; len(changes) != 2 {
+		t.Fatalf("expected 2 metadata changes; got %+v", changes)
+	}
+}
+
+func TestDrainMetaExpired(t *testing.T) {
+	now := time.Now()
+	if (DrainMeta{}).Expired(now) {
+		t.Fatal("a drain without lease should never expire")
+	}
+	meta := DrainMeta{TTL: "1m", Expires: now.Add(time.Minute).Unix()}
+	if meta.Expired(now) {
+		t.Fatal("lease expired too early")
+	}
+	if !meta.Expired(now.Add(2 * time.Minute)) {
+		t.Fatal("lease did not expire")
+	}
+}
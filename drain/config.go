@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/hpcloud/zmqpubsub"
+	"logyard/util/templatefuncs"
 	"net/url"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type DrainConfig struct {
@@ -22,8 +24,38 @@ type DrainConfig struct {
 	// template library; if
 	// format==raw, send the raw
 	// stream: "<key> <msg>"
-	Params    map[string]string // Params specific to that drain type.
-	rawFormat bool
+	FormatSpec string            // format as given in the uri (default: json)
+	Encoder    Encoder           // Builtin encoder selected by format (eg: logfmt)
+	Redactor   *Redactor         // Redacts records before formatting, if not nil.
+	Params     map[string]string // Params specific to that drain type.
+	rawFormat  bool
+
+	// Source, if not nil, is drained instead of the broker
+	// subscription to Filters; and Trace, if not nil, is called
+	// with the bytes written (or the error) for every message. Both
+	// are used by `logyard-cli test-drain`.
+	Source chan zmqpubsub.Message
+	Trace  func(msg zmqpubsub.Message, data []byte, err error)
+}
+
+// trace reports the outcome of writing msg to the drain destination.
+func (c *DrainConfig) trace(msg zmqpubsub.Message, data []byte, err error) {
+	if c.Trace != nil {
+		c.Trace(msg, data, err)
+	}
+}
+
+// Describe returns the parsed configuration as a map suitable for
+// display (see `logyard-cli add -dry-run`).
+func (c *DrainConfig) Describe() map[string]interface{} {
+	return map[string]interface{}{
+		"name":    c.Name,
+		"type":    c.Type,
+		"host":    c.Host,
+		"path":    c.Path,
+		"filters": c.Filters,
+		"format":  c.FormatSpec,
+		"params":  c.Params}
 }
 
 // GetParam returns the corresponding param; else the default value (def)
@@ -60,8 +92,44 @@ func (c *DrainConfig) GetParamBool(key string, def bool) (bool, error) {
 	return val, nil
 }
 
+func (c *DrainConfig) GetParamDuration(key string, def time.Duration) (time.Duration, error) {
+	data := c.GetParam(key, "")
+	if data == "" {
+		return def, nil
+	}
+	var val time.Duration
+	var err error
+	if val, err = time.ParseDuration(data); err != nil {
+		return 0, err
+	}
+	return val, nil
+}
+
+// redact returns the message with its record redacted, if the drain
+// has a redactor. Drains must use it on any record they send (or
+// derive keys from) without going through FormatJSON, and redact each
+// message only once, so that redactions are counted once.
+func (c *DrainConfig) redact(msg zmqpubsub.Message) (zmqpubsub.Message, error) {
+	if c.Redactor == nil {
+		return msg, nil
+	}
+	return c.Redactor.Redact(msg)
+}
+
 // FormatJSON formats the given message and returns it with a newline
 func (c *DrainConfig) FormatJSON(msg zmqpubsub.Message) ([]byte, error) {
+	msg, err := c.redact(msg)
+	if err != nil {
+		return nil, err
+	}
+	return c.format(msg)
+}
+
+// format is FormatJSON for messages that are already redacted.
+func (c *DrainConfig) format(msg zmqpubsub.Message) ([]byte, error) {
+	if c.Encoder != nil {
+		return c.Encoder.Encode(msg)
+	}
 	if c.Format == nil {
 		if c.rawFormat {
 			// <key> <json>
@@ -84,13 +152,44 @@ func (c *DrainConfig) FormatJSON(msg zmqpubsub.Message) ([]byte, error) {
 	return append(buf.Bytes(), byte('\n')), nil
 }
 
+// hasFormat returns true if the drain formats messages other than as
+// their JSON record.
+func (c *DrainConfig) hasFormat() bool {
+	return c.Format != nil || c.rawFormat || c.Encoder != nil
+}
+
+// formatRecord returns the redacted message and its record, along
+// with its text formatted as per the drain's format (without the
+// newline) if it has one. Drains that send the fields of the record,
+// rather than the output of FormatJSON, use it in place of the latter.
+func (c *DrainConfig) formatRecord(
+	msg zmqpubsub.Message) (zmqpubsub.Message, map[string]interface{}, string, error) {
+	msg, err := c.redact(msg)
+	if err != nil {
+		return msg, nil, "", err
+	}
+	var text string
+	if c.hasFormat() {
+		data, err := c.format(msg)
+		if err != nil {
+			return msg, nil, "", err
+		}
+		text = string(bytes.TrimRight(data, "\n"))
+	}
+	record := make(map[string]interface{})
+	if err = json.Unmarshal([]byte(msg.Value), &record); err != nil {
+		return msg, nil, "", err
+	}
+	return msg, record, text, nil
+}
+
 // ParseDrainUri creates a DrainConfig from the drain URI.
 func ParseDrainUri(name string, uri string, namedFormats map[string]string) (*DrainConfig, error) {
 	url, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
-	config := DrainConfig{Name: name, Type: url.Scheme}
+	config := DrainConfig{Name: name, Type: url.Scheme, FormatSpec: "json"}
 	if _, ok := DRAINS[config.Type]; !ok {
 		return nil, fmt.Errorf("unknown drain type: %s", uri)
 	}
@@ -123,10 +222,15 @@ func ParseDrainUri(name string, uri string, namedFormats map[string]string) (*Dr
 	}
 
 	// parse format
+	var encoder EncoderConstructor
 	if format, ok := params["format"]; ok {
 		params.Del("format")
+		config.FormatSpec = format[0]
 
-		if format[0] != "json" {
+		if constructor, ok := ENCODERS[format[0]]; ok {
+			// constructed below, as it may depend on the params.
+			encoder = constructor
+		} else if format[0] != "json" {
 			config.Format, config.rawFormat, err = parseFormat(name, format[0], namedFormats)
 			if err != nil {
 				return nil, err
@@ -141,6 +245,12 @@ func ParseDrainUri(name string, uri string, namedFormats map[string]string) (*Dr
 		config.Params[k] = v[0]
 	}
 
+	if encoder != nil {
+		if config.Encoder, err = encoder(&config); err != nil {
+			return nil, err
+		}
+	}
+
 	return &config, nil
 }
 
@@ -152,7 +262,7 @@ func parseFormat(
 	if value, ok := aliases[format]; ok {
 		format = value
 	}
-	tmpl, err := template.New(name).Parse(format)
+	tmpl, err := templatefuncs.New(name).Parse(format)
 	return tmpl, false, err
 }
 
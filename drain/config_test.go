@@ -2,6 +2,7 @@ package drain
 
 import (
 	"github.com/hpcloud/zmqpubsub"
+	"strings"
 	"testing"
 )
 
@@ -96,6 +97,99 @@ func TestURIConstruction(_t *testing.T) {
 		Params:    nil})
 }
 
+func TestStreamFields(t *testing.T) {
+	cfg, err := ParseDrainUri(
+		"stream", "redis://localhost:6379/?mode=stream", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := streamFields(cfg, zmqpubsub.Message{
+		"apptail.1", `{"text":"hello", "instance_index":2}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"instance_index", "2", "text", "hello"}
+	if strings.Join(fields, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected stream fields: %v", fields)
+	}
+}
+
+func TestRedisRedactsOnce(t *testing.T) {
+	cfg, err := ParseDrainUri("test.redisredact",
+		"redis://localhost:6379/?mode=stream&key={{.text}}&redact=bearer",
+		map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ClearDrainStats(cfg.Name)
+	if cfg.Redactor, err = NewRedactor(cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := parseRedisSettings(cfg.Name, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &RedisDrain{name: cfg.Name}
+	cmds, err := d.batchCommands(cfg, settings, []zmqpubsub.Message{
+		{Key: "apptail.1", Value: `{"text":"Bearer abc123"}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "XADD Bearer " + REDACTED + " MAXLEN ~ 1500 * text Bearer " + REDACTED
+	if len(cmds.args) != 1 || strings.Join(cmds.args[0], " ") != expected {
+		t.Fatalf("stream entry not redacted: %q", cmds.args)
+	}
+	if n := GetDrainStats(cfg.Name).Get("redactions"); n != 1 {
+		t.Fatalf("expected 1 redaction; got %d", n)
+	}
+}
+
+func TestStreamSkipsEmptyRecords(t *testing.T) {
+	cfg, err := ParseDrainUri("test.emptystream",
+		"redis://localhost:6379/?mode=stream", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := parseRedisSettings("test.emptystream", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ClearDrainStats("test.emptystream")
+	d := &RedisDrain{name: "test.emptystream"}
+	cmds, err := d.batchCommands(cfg, settings, []zmqpubsub.Message{
+		{Key: "apptail.1", Value: `{}`},
+		{Key: "apptail.1", Value: `{"text":"hello"}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds.args) != 1 || strings.Join(cmds.args[0], " ") !=
+		"XADD apptail.1 MAXLEN ~ 1500 * text hello" {
+		t.Fatalf("unexpected commands: %q", cmds.args)
+	}
+	if n := GetDrainStats("test.emptystream").Get("redis.emptyrecord"); n != 1 {
+		t.Fatalf("expected 1 empty record to be skipped; got %d", n)
+	}
+}
+
+func TestRedisKeyTemplate(t *testing.T) {
+	keyer, err := newRedisKeyer(
+		"applog", "applog:{{.app_id}}:{{.instance_index}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keyer.Key(zmqpubsub.Message{
+		"apptail.1", `{"app_id":1, "instance_index":0, "text":"hi"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "applog:1:0" {
+		t.Fatalf("unexpected key: %s", key)
+	}
+	if _, err = keyer.Key(zmqpubsub.Message{"apptail.1", `{"text":"hi"}`}); err == nil {
+		t.Fatal("expected an error for a record without app_id")
+	}
+}
+
 // Test library
 
 type DrainConfigTest struct {
@@ -0,0 +1,249 @@
+package drain
+
+import (
+	"fmt"
+	"github.com/hpcloud/log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CONTROL_SOCKET is the unix socket on which the logyard daemon
+// answers JSON-RPC queries about its drains (see ServeControl). Only
+// its owner (the user logyard runs as) may connect to it, as it is
+// created in a directory private to the owner.
+const CONTROL_SOCKET = "/var/stackato/run/logyard/control.sock"
+
+// Drain params whose values are masked in DrainInfo; as are those
+// whose name contains one of these (eg: redis_password).
+var controlSecretParams = []string{"password", "passwd", "secret", "token", "sharedkey", "apikey"}
+
+const controlMask = "xxxxx"
+
+// DrainInfo is the live state of a drain, as known to the drain
+// manager running it.
+type DrainInfo struct {
+	Name    string                 `json:"name"`
+	State   string                 `json:"state"`
+	Rev     int64                  `json:"rev"`
+	Error   string                 `json:"error,omitempty"` // last error, if any
+	Started int64                  `json:"started"`         // unix time
+	Since   int64                  `json:"since"`           // unix time State was entered
+	Uptime  int64                  `json:"uptime"`          // seconds RUNNING, if so
+	URI     string                 `json:"uri"`
+	Config  map[string]interface{} `json:"config"`
+}
+
+// DrainInfos returns the live state of the drains started on this
+// node, sorted by name.
+func (manager *DrainManager) DrainInfos() []DrainInfo {
+	var infos []DrainInfo
+	manager.send(&command{action: cmdQuery, query: func() {
+		now := time.Now()
+		for name, stm := range manager.stmMap {
+			status := stm.GetStatus()
+			process := manager.procMap[name]
+			info := DrainInfo{
+				Name:    name,
+				Rev:     status.Rev,
+				Error:   status.LastError,
+				Started: manager.startMap[name].Unix(),
+				Since:   status.Since.Unix(),
+				URI:     maskURI(process.uri),
+				Config:  maskConfig(process.cfg.Describe())}
+			if status.State != nil {
+				info.State = status.State.String()
+			}
+			if info.State == "RUNNING" {
+				info.Uptime = int64(now.Sub(status.Since) / time.Second)
+			}
+			infos = append(infos, info)
+		}
+	}})
+	sort.Sort(drainInfosByName(infos))
+	return infos
+}
+
+// maskURI returns the drain uri with its password and secret params
+// masked.
+func maskURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// can't tell what is secret.
+		return controlMask
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), controlMask)
+		}
+	}
+	query := u.Query()
+	for name, _ := range query {
+		if isSecretParam(name) {
+			query.Set(name, controlMask)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// maskConfig masks the secret params of a described drain config.
+func maskConfig(config map[string]interface{}) map[string]interface{} {
+	if params, ok := config["params"].(map[string]string); ok {
+		masked := make(map[string]string, len(params))
+		for name, value := range params {
+			if isSecretParam(name) {
+				value = controlMask
+			}
+			masked[name] = value
+		}
+		config["params"] = masked
+	}
+	return config
+}
+
+func isSecretParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range controlSecretParams {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+type drainInfosByName []DrainInfo
+
+func (s drainInfosByName) Len() int           { return len(s) }
+func (s drainInfosByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s drainInfosByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Control is the JSON-RPC service (named "Drains") exposed on the
+// control socket.
+type Control struct {
+	manager *DrainManager
+}
+
+// ControlArgs selects the drains of a control request; all drains if
+// Names is empty.
+type ControlArgs struct {
+	Names []string
+	State string // Restart: only drains in this state (eg: FATAL)
+}
+
+func (args *ControlArgs) selects(name string) bool {
+	if len(args.Names) == 0 {
+		return true
+	}
+	for _, n := range args.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the live state of the selected drains.
+func (c *Control) Status(args *ControlArgs, reply *[]DrainInfo) error {
+	// A nil reply would be sent as a null result, which jsonrpc
+	// clients reject.
+	*reply = []DrainInfo{}
+	for _, info := range c.manager.DrainInfos() {
+		if args.selects(info.Name) {
+			*reply = append(*reply, info)
+		}
+	}
+	return nil
+}
+
+// Restart restarts the selected drains, returning their names.
+func (c *Control) Restart(args *ControlArgs, reply *[]string) error {
+	restarted, err := c.manager.RestartDrains(args.Names, args.State)
+	*reply = append([]string{}, restarted...)
+	return err
+}
+
+// ServeControl serves the control service on the unix socket at path,
+// until the manager is shut down.
+func (manager *DrainManager) ServeControl(path string) error {
+	// Drains can be restarted through the socket, which is only
+	// chmod-ed after being created; so it is created in a directory
+	// that others cannot access in the meantime.
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return err
+	} else if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("control socket directory %s is accessible to others (%v)",
+			dir, fi.Mode().Perm())
+	}
+	// Remove the socket left behind by a previous run.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	server := rpc.NewServer()
+	if err = server.RegisterName("Drains", &Control{manager}); err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		<-manager.done
+		listener.Close()
+	}()
+	log.Infof("Serving drain control requests on %s", path)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-manager.done:
+				return nil
+			default:
+				return err
+			}
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// callControl calls the named method of the control service at path.
+func callControl(path, method string, args, reply interface{}) error {
+	client, err := jsonrpc.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to logyard at %s: %v", path, err)
+	}
+	defer client.Close()
+	return client.Call("Drains."+method, args, reply)
+}
+
+// QueryDrains returns the live state of the named drains (all if
+// none) from the logyard daemon serving the control socket at path.
+func QueryDrains(path string, names []string) ([]DrainInfo, error) {
+	var infos []DrainInfo
+	err := callControl(path, "Status", &ControlArgs{Names: names}, &infos)
+	return infos, err
+}
+
+// RestartDrains asks the logyard daemon serving the control socket at
+// path to restart the named drains (all if none) that are in the
+// given state (any if empty), returning the names of those restarted.
+func RestartDrains(path string, names []string, state string) ([]string, error) {
+	var restarted []string
+	err := callControl(path, "Restart", &ControlArgs{names, state}, &restarted)
+	return restarted, err
+}
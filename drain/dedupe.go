@@ -0,0 +1,128 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// Deduper is a drain stage collapsing identical consecutive records
+// from the same source (message key) into the first record followed
+// by a "last message repeated N times" summary, à la syslog. It is
+// configured by the drain params:
+//
+//	dedupe=30s               window after which repeats are summarized
+//	dedupeby=name,text       record fields compared (default: text)
+//
+// Records lacking all of the compared fields are compared by type and
+// desc if they are cloud events (which have no text), and as a whole
+// otherwise.
+type Deduper struct {
+	window  time.Duration
+	fields  []string
+	sources map[string]*dedupeSource
+	stats   *DrainStats
+}
+
+type dedupeSource struct {
+	signature string
+	since     time.Time // start of the current window
+	seen      time.Time // last time a record was seen
+	repeated  int64
+	last      zmqpubsub.Message
+}
+
+func NewDeduper(config *DrainConfig) (Stage, error) {
+	window, err := config.GetParamDuration("dedupe", 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dedupe window: %s", err)
+	}
+	if window <= 0 {
+		return nil, nil
+	}
+	return &Deduper{
+		window:  window,
+		fields:  strings.Split(config.GetParam("dedupeby", "text"), ","),
+		sources: make(map[string]*dedupeSource),
+		stats:   GetDrainStats(config.Name),
+	}, nil
+}
+
+func (d *Deduper) Process(msg zmqpubsub.Message, now time.Time) []zmqpubsub.Message {
+	signature := d.signature(msg)
+	src, ok := d.sources[msg.Key]
+	if !ok {
+		src = &dedupeSource{}
+		d.sources[msg.Key] = src
+	}
+	src.seen = now
+
+	if ok && signature == src.signature {
+		if src.repeated == 0 {
+			src.since = now
+		}
+		src.repeated++
+		src.last = msg
+		d.stats.Add("deduplicated", 1)
+		return nil
+	}
+
+	msgs := d.flush(src)
+	src.signature = signature
+	return append(msgs, msg)
+}
+
+func (d *Deduper) Tick(now time.Time) []zmqpubsub.Message {
+	var msgs []zmqpubsub.Message
+	for key, src := range d.sources {
+		if src.repeated > 0 && now.Sub(src.since) >= d.window {
+			msgs = append(msgs, d.flush(src)...)
+		} else if src.repeated == 0 && now.Sub(src.seen) >= d.window {
+			// Forget idle sources.
+			delete(d.sources, key)
+		}
+	}
+	return msgs
+}
+
+// flush returns the summary of repeats from the source, if any.
+func (d *Deduper) flush(src *dedupeSource) []zmqpubsub.Message {
+	if src.repeated == 0 {
+		return nil
+	}
+	record, err := decodeRecord(src.last)
+	if err != nil {
+		record = make(map[string]interface{})
+	}
+	record[textField(record)] = fmt.Sprintf(
+		"last message repeated %d times", src.repeated)
+	data, _ := json.Marshal(record)
+	src.repeated = 0
+	return []zmqpubsub.Message{{Key: src.last.Key, Value: string(data)}}
+}
+
+// signature returns the values of the compared fields of the record.
+func (d *Deduper) signature(msg zmqpubsub.Message) string {
+	record, err := decodeRecord(msg)
+	if err != nil {
+		return msg.Value
+	}
+	values := make([]string, len(d.fields))
+	found := false
+	for idx, field := range d.fields {
+		value := LookupField(record, field)
+		found = found || value != nil
+		values[idx] = fieldString(value)
+	}
+	if !found {
+		if _, ok := record["desc"]; !ok {
+			return msg.Value
+		}
+		values = []string{fieldString(record["type"]), fieldString(record["desc"])}
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
@@ -0,0 +1,101 @@
+package drain
+
+import (
+	"github.com/hpcloud/zmqpubsub"
+	"testing"
+	"time"
+)
+
+func TestDedupe(t *testing.T) {
+	stage, err := NewDeduper(parseTestUri(t, "dedupe=10s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	texts := []string{"retrying", "retrying", "retrying", "connected", "connected"}
+	var out []zmqpubsub.Message
+	for _, text := range texts {
+		out = append(out, stage.Process(zmqpubsub.Message{
+			Key: "systail.dea", Value: `{"text":"` + text + `"}`}, now)...)
+		// An interleaved source does not break the repeats of another.
+		out = append(out, stage.Process(zmqpubsub.Message{
+			Key: "systail.cc", Value: `{"text":"hello"}`}, now)...)
+	}
+	expectTexts(t, out,
+		"retrying", "hello", "last message repeated 2 times", "connected")
+
+	// Pending repeats are summarized after the window.
+	if out = stage.Tick(now.Add(5 * time.Second)); len(out) != 0 {
+		t.Fatalf("unexpected summary before the window: %v", out)
+	}
+	expectTexts(t, stage.Tick(now.Add(10*time.Second)),
+		"last message repeated 1 times", "last message repeated 4 times")
+}
+
+func TestDedupeEvents(t *testing.T) {
+	stage, err := NewDeduper(parseTestUri(t, "dedupe=10s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	event := func(desc string) zmqpubsub.Message {
+		return zmqpubsub.Message{Key: "event.dea",
+			Value: `{"type":"dea_start","desc":"` + desc + `","severity":"INFO"}`}
+	}
+	// Events have no text; distinct ones must not be merged.
+	var out []zmqpubsub.Message
+	for _, desc := range []string{"started app1", "started app2", "started app2"} {
+		out = append(out, stage.Process(event(desc), now)...)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 distinct events; got %v", out)
+	}
+
+	out = stage.Tick(now.Add(10 * time.Second))
+	if len(out) != 1 {
+		t.Fatalf("expected a summary; got %v", out)
+	}
+	record, err := decodeRecord(out[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := record["text"]; ok || record["desc"] != "last message repeated 1 times" {
+		t.Fatalf("unexpected event summary: %v", record)
+	}
+}
+
+func TestDedupeDisabled(t *testing.T) {
+	stage, err := NewDeduper(parseTestUri(t, "limit=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage != nil {
+		t.Fatal("expected no deduper when not configured")
+	}
+}
+
+func expectTexts(t *testing.T, msgs []zmqpubsub.Message, texts ...string) {
+	var got []string
+	for _, msg := range msgs {
+		record, err := decodeRecord(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, record["text"].(string))
+	}
+	// Order of messages emitted by Tick is not defined.
+	if len(got) != len(texts) {
+		t.Fatalf("expected %v; got %v", texts, got)
+	}
+	for _, text := range texts {
+		found := false
+		for _, g := range got {
+			if g == text {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected %v; got %v", texts, got)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package drain
 
 import (
 	"fmt"
+	"github.com/hpcloud/zmqpubsub"
 	"logyard"
+	"sync"
+	"time"
 )
 
 type DrainType interface {
@@ -14,33 +17,134 @@ type DrainType interface {
 	WaitRunning() bool
 }
 
+// DrainChecker is implemented by drain types that can check a drain
+// configuration before it is saved (see `logyard-cli add`).
+type DrainChecker interface {
+	// Validate checks the params specific to the drain type.
+	Validate(*DrainConfig) error
+	// TestConnection attempts to connect to (or open) the drain
+	// destination, disconnecting immediately.
+	TestConnection(*DrainConfig) error
+}
+
+// DrainFlusher is implemented by drains that can stop gracefully:
+// Flush makes the drain stop receiving messages, write out those
+// already queued, and exit.
+type DrainFlusher interface {
+	Flush()
+}
+
+// flusher implements DrainFlusher, for embedding in drains which
+// select on Flushing() in their main loop.
+type flusher struct {
+	once sync.Once
+	ch   chan bool
+}
+
+func newFlusher() *flusher {
+	return &flusher{ch: make(chan bool)}
+}
+
+func (f *flusher) Flush() {
+	f.once.Do(func() { close(f.ch) })
+}
+
+// Flushing returns a channel that is closed when Flush is called.
+func (f *flusher) Flushing() <-chan bool {
+	return f.ch
+}
+
 // DrainConstructor is a function that returns a new drain instance
 type DrainConstructor func(string) DrainType
 
 // DRAINS is a map of drain type (string) to its constructur function
 var DRAINS = map[string]DrainConstructor{
-	"redis": NewRedisDrain,
-	"tcp":   NewIPConnDrain,
-	"udp":   NewIPConnDrain,
-	"file":  NewFileDrain,
+	"redis":      NewRedisDrain,
+	"tcp":        NewIPConnDrain,
+	"udp":        NewIPConnDrain,
+	"file":       NewFileDrain,
+	"kafka":      NewKafkaDrain,
+	"gelf":       NewGelfDrain,
+	"fluent":     NewFluentDrain,
+	"otlp+http":  NewOTLPDrain,
+	"otlp+https": NewOTLPDrain,
 }
 
 type DrainProcess struct {
 	drain       DrainType
 	name        string
+	uri         string
 	cfg         *DrainConfig
 	constructor DrainConstructor
 }
 
+// NewDrainConfig creates the DrainConfig for the drain URI, using the
+// named formats and redaction rules from the logyard config.
+func NewDrainConfig(name, uri string) (*DrainConfig, error) {
+	config := logyard.GetConfig()
+	cfg, err := ParseDrainUri(name, uri, config.DrainFormats)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid drain URI (%s): %s", uri, err)
+	}
+	cfg.Redactor, err = NewRedactor(cfg, config.Redact, config.RedactRules)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ValidateDrainConfig checks the params common to all drains (queue,
+// stages) as well as those specific to the drain type.
+func ValidateDrainConfig(cfg *DrainConfig) error {
+	if _, err := NewMessageQueue(cfg.Name, cfg); err != nil {
+		return err
+	}
+	if _, err := placementParams(
+		cfg.GetParam("placement", ""), cfg.GetParam("singleton", "")); err != nil {
+		return err
+	}
+	if constructor, ok := DRAINS[cfg.Type]; ok && constructor != nil {
+		if checker, ok := constructor(cfg.Name).(DrainChecker); ok {
+			return checker.Validate(cfg)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported drain type: %s", cfg.Type)
+}
+
+// TestDrainConnection attempts to connect to the drain destination, if
+// the drain type supports it.
+func TestDrainConnection(cfg *DrainConfig) error {
+	if constructor, ok := DRAINS[cfg.Type]; ok && constructor != nil {
+		if checker, ok := constructor(cfg.Name).(DrainChecker); ok {
+			return checker.TestConnection(cfg)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported drain type: %s", cfg.Type)
+}
+
+// subscribe returns the channel of messages to drain -- config.Source
+// if set, else a broker subscription to the drain's filters -- along
+// with the function releasing it.
+func subscribe(config *DrainConfig) (chan zmqpubsub.Message, func()) {
+	if config.Source != nil {
+		return config.Source, func() {}
+	}
+	sub := logyard.Broker.Subscribe(config.Filters...)
+	return sub.Ch, func() { sub.Stop() }
+}
+
 func NewDrainProcess(name, uri string) (*DrainProcess, error) {
 	p := &DrainProcess{}
 
-	cfg, err := ParseDrainUri(name, uri, logyard.GetConfig().DrainFormats)
+	cfg, err := NewDrainConfig(name, uri)
 	if err != nil {
-		return nil, fmt.Errorf("[drain:%s] Invalid drain URI (%s): %s", name, uri, err)
+		return nil, fmt.Errorf("[drain:%s] %s", name, err)
 	}
 
 	p.name = name
+	p.uri = uri
 	p.cfg = cfg
 
 	if constructor, ok := DRAINS[cfg.Type]; ok && constructor != nil {
@@ -65,6 +169,16 @@ func (p *DrainProcess) WaitRunning() bool {
 	return p.drain.WaitRunning()
 }
 
+// Flush asks the drain to write out its queued messages and exit,
+// returning false if the drain does not support it.
+func (p *DrainProcess) Flush() bool {
+	if f, ok := p.drain.(DrainFlusher); ok {
+		f.Flush()
+		return true
+	}
+	return false
+}
+
 func (p *DrainProcess) Stop() error {
 	return p.drain.Stop()
 }
@@ -81,3 +195,36 @@ func (p *DrainProcess) Logf(msg string, v ...interface{}) string {
 	v = append([]interface{}{p.String()}, v...)
 	return fmt.Sprintf("[%s] "+msg, v...)
 }
+
+// recordTime returns the time of a systail, apptail or event record,
+// preferring the precise syslog time.
+func recordTime(record map[string]interface{}) time.Time {
+	if syslog, ok := record["syslog"].(map[string]interface{}); ok {
+		if s, ok := syslog["time"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t
+			}
+		}
+	}
+	if unixTime, ok := record["unix_time"].(float64); ok {
+		return time.Unix(int64(unixTime), 0)
+	}
+	return time.Now()
+}
+
+// textField returns the field holding the text of the record, which
+// is `desc` for cloud events.
+func textField(record map[string]interface{}) string {
+	if _, ok := record["text"]; !ok {
+		if _, ok := record["desc"]; ok {
+			return "desc"
+		}
+	}
+	return "text"
+}
+
+// recordText returns the text of the record (see textField).
+func recordText(record map[string]interface{}) string {
+	text, _ := record[textField(record)].(string)
+	return text
+}
@@ -0,0 +1,136 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/redis"
+	"time"
+)
+
+// How long a node remains the elected leader for a drain without
+// renewing its lease.
+const LEADER_LEASE = 30 * time.Second
+
+// Acquire the lease if free, or renew it if already held by us
+// (ARGV[1]), for ARGV[2] milliseconds.
+const campaignScript = `
+local holder = redis.call('GET', KEYS[1])
+if holder == false or holder == ARGV[1] then
+  redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+  return 1
+end
+return 0`
+
+// Release the lease only if held by us.
+const resignScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// Elector elects a single node to run a drain, using a lease stored
+// in redis that the leader must renew (by campaigning again) before
+// it expires.
+type Elector struct {
+	Prefix string // redis key prefix for the leases
+	Host   string // identifies this node as a leader
+	Lease  time.Duration
+	Client *redis.Client
+}
+
+// LeaderInfo records the leadership of a drain, as shown by `status`.
+// Times are in unix milliseconds.
+type LeaderInfo struct {
+	Leader   string `json:"leader"`
+	Since    int64  `json:"since"`   // when Leader was elected
+	Renewed  int64  `json:"renewed"` // last renewal (or resignation)
+	Previous string `json:"previous,omitempty"`
+	// How long the drain went without a leader before Leader was
+	// elected.
+	Failover int64 `json:"failover_ms,omitempty"`
+}
+
+// Campaign attempts to become, or remain, the leader for the drain.
+func (e *Elector) Campaign(name string) (bool, error) {
+	req := redis.NewIntReq(
+		"EVAL", campaignScript, "1", e.Prefix+name, e.Host,
+		fmt.Sprintf("%d", int64(e.Lease/time.Millisecond)))
+	e.Client.Process(req)
+	if err := req.Err(); err != nil {
+		return false, err
+	}
+	if req.Val() != 1 {
+		return false, nil
+	}
+	return true, e.updateInfo(name, false)
+}
+
+// Resign gives up the leadership of the drain, if held, so that
+// another node can take over without waiting for the lease to expire.
+func (e *Elector) Resign(name string) error {
+	req := redis.NewIntReq("EVAL", resignScript, "1", e.Prefix+name, e.Host)
+	e.Client.Process(req)
+	if err := req.Err(); err != nil || req.Val() != 1 {
+		return err
+	}
+	return e.updateInfo(name, true)
+}
+
+// Forget deletes the lease and leadership record of a deleted drain.
+func (e *Elector) Forget(name string) error {
+	return e.Client.Del(e.Prefix+name, e.Prefix+name+":info").Err()
+}
+
+// Leader returns the current leader for the drain, if any.
+func (e *Elector) Leader(name string) (string, error) {
+	return e.get(e.Prefix + name)
+}
+
+// Info returns the leadership record of the drain, which is nil if
+// it never had a leader.
+func (e *Elector) Info(name string) (*LeaderInfo, error) {
+	data, err := e.get(e.Prefix + name + ":info")
+	if err != nil || data == "" {
+		return nil, err
+	}
+	info := new(LeaderInfo)
+	return info, json.Unmarshal([]byte(data), info)
+}
+
+// updateInfo updates the leadership record of the drain, of which we
+// are (or just were, if resigned) the leader.
+func (e *Elector) updateInfo(name string, resigned bool) error {
+	info, err := e.Info(name)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		info = new(LeaderInfo)
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if resigned {
+		info.Previous, info.Leader = info.Leader, ""
+	} else if info.Leader != e.Host {
+		if info.Leader != "" {
+			info.Previous = info.Leader
+		}
+		if info.Renewed != 0 {
+			info.Failover = now - info.Renewed
+		}
+		info.Leader = e.Host
+		info.Since = now
+	}
+	info.Renewed = now
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return e.Client.Set(e.Prefix+name+":info", string(data)).Err()
+}
+
+func (e *Elector) get(key string) (string, error) {
+	req := redis.NewStringReq(
+		"EVAL", "return redis.call('GET', KEYS[1]) or ''", "1", key)
+	e.Client.Process(req)
+	return req.Val(), req.Err()
+}
@@ -0,0 +1,213 @@
+package drain
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"logyard/util/msgpack"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/stackato-go/server"
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// Encoder encodes messages into the bytes to be written by the
+// drain, as an alternative to text templates.
+type Encoder interface {
+	Encode(msg zmqpubsub.Message) ([]byte, error)
+}
+
+// EncoderConstructor returns a new encoder configured from the drain
+// params.
+type EncoderConstructor func(*DrainConfig) (Encoder, error)
+
+// ENCODERS is a map of builtin format names (as in `format=logfmt`)
+// to their encoder constructor.
+var ENCODERS = map[string]EncoderConstructor{
+	"logfmt":         NewLogfmtEncoder,
+	"csv":            NewCSVEncoder,
+	"msgpack":        NewMsgpackEncoder,
+	"jsonl-envelope": NewEnvelopeEncoder,
+}
+
+// LogfmtEncoder encodes records as `key=value` pairs, with nested
+// fields flattened to dotted keys (eg: syslog.priority=14).
+type LogfmtEncoder struct{}
+
+func NewLogfmtEncoder(config *DrainConfig) (Encoder, error) {
+	return LogfmtEncoder{}, nil
+}
+
+func (e LogfmtEncoder) Encode(msg zmqpubsub.Message) ([]byte, error) {
+	record, err := decodeRecord(msg)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	flattenRecord("", record, fields)
+	keys := make([]string, 0, len(fields))
+	for k, _ := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for idx, k := range keys {
+		if idx > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fields[k]))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		data, _ := json.Marshal(s)
+		return string(data)
+	}
+	return s
+}
+
+// CSVEncoder encodes the record fields listed in the `fields` param
+// (comma separated, nested fields are dotted) as a CSV row.
+type CSVEncoder struct {
+	fields []string
+}
+
+func NewCSVEncoder(config *DrainConfig) (Encoder, error) {
+	fields := config.GetParam("fields", "")
+	if fields == "" {
+		return nil, fmt.Errorf("csv format requires the `fields` param")
+	}
+	return CSVEncoder{strings.Split(fields, ",")}, nil
+}
+
+func (e CSVEncoder) Encode(msg zmqpubsub.Message) ([]byte, error) {
+	record, err := decodeRecord(msg)
+	if err != nil {
+		return nil, err
+	}
+	row := make([]string, len(e.fields))
+	for idx, field := range e.fields {
+		row[idx] = fieldString(LookupField(record, field))
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(row)
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// MsgpackEncoder encodes records in the MessagePack format, which
+// is self-delimiting; no newline is added.
+type MsgpackEncoder struct{}
+
+func NewMsgpackEncoder(config *DrainConfig) (Encoder, error) {
+	return MsgpackEncoder{}, nil
+}
+
+func (e MsgpackEncoder) Encode(msg zmqpubsub.Message) ([]byte, error) {
+	record, err := decodeRecord(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(record)
+}
+
+// EnvelopeEncoder wraps the record in a JSON object along with the
+// message key, the node it was received on and the receive time.
+type EnvelopeEncoder struct{}
+
+func NewEnvelopeEncoder(config *DrainConfig) (Encoder, error) {
+	return EnvelopeEncoder{}, nil
+}
+
+type envelope struct {
+	Key      string          `json:"key"`
+	Node     string          `json:"node"`
+	Received string          `json:"received"`
+	Record   json.RawMessage `json:"record"`
+}
+
+func (e EnvelopeEncoder) Encode(msg zmqpubsub.Message) ([]byte, error) {
+	data, err := json.Marshal(envelope{
+		msg.Key,
+		localNodeID(),
+		time.Now().UTC().Format(time.RFC3339Nano),
+		json.RawMessage(msg.Value)})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+var nodeIDOnce sync.Once
+var nodeID string
+
+// localNodeID returns the IP address of this node, falling back to
+// its host name.
+func localNodeID() string {
+	nodeIDOnce.Do(func() {
+		var err error
+		if nodeID, err = server.LocalIP(); err != nil || nodeID == "" {
+			nodeID, _ = os.Hostname()
+		}
+	})
+	return nodeID
+}
+
+func decodeRecord(msg zmqpubsub.Message) (map[string]interface{}, error) {
+	record := make(map[string]interface{})
+	err := json.Unmarshal([]byte(msg.Value), &record)
+	return record, err
+}
+
+// LookupField returns the value of the given field in the record,
+// where nested fields are separated by dots (eg: "syslog.priority").
+func LookupField(record map[string]interface{}, field string) interface{} {
+	var value interface{} = record
+	for _, part := range strings.Split(field, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if value, ok = m[part]; !ok {
+			return nil
+		}
+	}
+	return value
+}
+
+// flattenRecord flattens nested fields of the record into dotted
+// keys, storing their string values in fields.
+func flattenRecord(prefix string, record map[string]interface{}, fields map[string]string) {
+	for k, v := range record {
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenRecord(prefix+k+".", nested, fields)
+		} else {
+			fields[prefix+k] = fieldString(v)
+		}
+	}
+}
+
+// fieldString returns the string representation of a decoded JSON
+// value; strings as is, other values as JSON.
+func fieldString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,84 @@
+package drain
+
+import (
+	"encoding/json"
+	"github.com/hpcloud/zmqpubsub"
+	"testing"
+)
+
+var encoderTestMessage = zmqpubsub.Message{
+	Key: "systail.dea.192.168.1.2",
+	Value: `{"name":"dea", "node_id":"192.168.1.2", ` +
+		`"text":"started app", "syslog":{"priority":14}}`}
+
+func TestLogfmtEncoder(t *testing.T) {
+	expectEncoded(t, "format=logfmt",
+		`name=dea node_id=192.168.1.2 syslog.priority=14 text="started app"`+"\n")
+}
+
+func TestCSVEncoder(t *testing.T) {
+	expectEncoded(t, "format=csv&fields=node_id,syslog.priority,text,missing",
+		"192.168.1.2,14,started app,\n")
+}
+
+func TestCSVEncoderRequiresFields(t *testing.T) {
+	_, err := ParseDrainUri(
+		"test", "tcp://localhost:1/?format=csv", map[string]string{})
+	if err == nil {
+		t.Fatal("expected an error for csv without fields")
+	}
+}
+
+func TestMsgpackEncoder(t *testing.T) {
+	cfg := parseTestUri(t, "format=msgpack")
+	data, err := cfg.FormatJSON(zmqpubsub.Message{Key: "k", Value: `{"a":1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "\x81\xa1a\x01" {
+		t.Fatalf("unexpected msgpack encoding: %x", data)
+	}
+}
+
+func TestEnvelopeEncoder(t *testing.T) {
+	cfg := parseTestUri(t, "format=jsonl-envelope")
+	data, err := cfg.FormatJSON(encoderTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env map[string]interface{}
+	if err = json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env["key"] != encoderTestMessage.Key {
+		t.Fatalf("unexpected key in envelope: %v", env["key"])
+	}
+	if record, ok := env["record"].(map[string]interface{}); !ok || record["name"] != "dea" {
+		t.Fatalf("unexpected record in envelope: %v", env["record"])
+	}
+	if _, ok := env["received"].(string); !ok {
+		t.Fatal("missing receive timestamp")
+	}
+}
+
+// Test library
+
+func parseTestUri(t *testing.T, query string) *DrainConfig {
+	cfg, err := ParseDrainUri(
+		"test", "tcp://localhost:1/?"+query, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func expectEncoded(t *testing.T, query, expected string) {
+	cfg := parseTestUri(t, query)
+	data, err := cfg.FormatJSON(encoderTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != expected {
+		t.Fatalf("expected `%s`; got `%s`", expected, data)
+	}
+}
@@ -1,8 +1,10 @@
 package drain
 
 import (
-	"logyard"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/hpcloud/log"
 	"gopkg.in/tomb.v1"
@@ -12,6 +14,7 @@ import (
 type FileDrain struct {
 	name   string
 	initCh chan bool
+	*flusher
 	tomb.Tomb
 }
 
@@ -19,13 +22,54 @@ func NewFileDrain(name string) DrainType {
 	var d FileDrain
 	d.name = name
 	d.initCh = make(chan bool)
+	d.flusher = newFlusher()
 	return &d
 }
 
+func parseFileSettings(config *DrainConfig) (overwrite bool, err error) {
+	if config.Path == "" {
+		return false, fmt.Errorf("missing file path")
+	}
+	return config.GetParamBool("overwrite", false)
+}
+
+func (d *FileDrain) Validate(config *DrainConfig) error {
+	_, err := parseFileSettings(config)
+	return err
+}
+
+func (d *FileDrain) TestConnection(config *DrainConfig) error {
+	// Do not truncate, or create, the file.
+	if _, err := os.Stat(config.Path); os.IsNotExist(err) {
+		return checkDirWritable(filepath.Dir(config.Path))
+	}
+	f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkDirWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".logyard-test")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 func (d *FileDrain) Start(config *DrainConfig) {
 	defer d.Done()
 
-	overwrite, err := config.GetParamBool("overwrite", false)
+	overwrite, err := parseFileSettings(config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	queue, err := NewMessageQueue(d.name, config)
 	if err != nil {
 		d.Kill(err)
 		go d.finishedStarting(false)
@@ -49,24 +93,44 @@ func (d *FileDrain) Start(config *DrainConfig) {
 	log.Infof("[drain:%s] Successfully opened %s.", d.name, config.Path)
 	defer f.Close()
 
-	sub := logyard.Broker.Subscribe(config.Filters...)
-	defer sub.Stop()
+	source, unsubscribe := subscribe(config)
+	defer unsubscribe()
+
+	if err := queue.Start(source); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer queue.Stop()
 
 	go d.finishedStarting(true)
 
+	flushing := d.Flushing()
 	for {
 		select {
-		case msg := <-sub.Ch:
+		case <-flushing:
+			flushing = nil
+			queue.Close()
+		case msg, ok := <-queue.Ch:
+			if !ok {
+				// flushed
+				return
+			}
 			data, err := config.FormatJSON(msg)
 			if err != nil {
+				config.trace(msg, nil, err)
 				d.Kill(err)
 				return
 			}
 			_, err = f.Write(data)
+			config.trace(msg, data, err)
 			if err != nil {
 				d.Kill(err)
 				return
 			}
+		case <-queue.Dying():
+			d.Kill(queue.Err())
+			return
 		case <-d.Dying():
 			return
 		}
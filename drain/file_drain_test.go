@@ -0,0 +1,63 @@
+package drain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+func TestFileDrainSourceAndTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logyard-file-drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	cfg, err := ParseDrainUri(
+		"test.file", "file://"+path+"?format={{.text}}", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced := make(chan string, 1)
+	cfg.Source = make(chan zmqpubsub.Message)
+	cfg.Trace = func(msg zmqpubsub.Message, data []byte, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		traced <- string(data)
+	}
+
+	d := NewFileDrain("test.file")
+	go d.Start(cfg)
+	if !d.WaitRunning() {
+		t.Fatal(d.Wait())
+	}
+	defer d.Stop()
+
+	msg, err := SampleMessage("apptail", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Source <- msg
+	select {
+	case data := <-traced:
+		if data != "sample apptail message #1\n" {
+			t.Fatalf("unexpected data: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the message to be written")
+	}
+
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "sample apptail message #1\n" {
+		t.Fatalf("unexpected file contents: %q", written)
+	}
+}
@@ -0,0 +1,461 @@
+package drain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"logyard/util/msgpack"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hpcloud/log"
+	"github.com/hpcloud/zmqpubsub"
+	"gopkg.in/tomb.v1"
+)
+
+// Defaults for the fluent drain `batch` and `acktimeout` params, and
+// port.
+const (
+	DEFAULT_FLUENT_BATCH       = 100
+	DEFAULT_FLUENT_ACK_TIMEOUT = 30 * time.Second
+	DEFAULT_FLUENT_PORT        = "24224"
+)
+
+// FluentDrain forwards messages to Fluentd (or Fluent Bit) using the
+// forward protocol, tagging them with the message key, eg:
+// fluent://aggregator:24224?tagprefix=logyard&ack=true&sharedkey=secret
+//
+// https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+type FluentDrain struct {
+	name   string
+	initCh chan bool
+	*flusher
+	tomb.Tomb
+}
+
+func NewFluentDrain(name string) DrainType {
+	var d FluentDrain
+	d.name = name
+	d.initCh = make(chan bool)
+	d.flusher = newFlusher()
+	return &d
+}
+
+// fluentSettings are the FluentDrain specific params.
+type fluentSettings struct {
+	host         string
+	tagPrefix    string
+	ack          bool
+	ackTimeout   time.Duration
+	batchSize    int
+	writeTimeout time.Duration
+	// for the shared key handshake, if sharedKey is set.
+	sharedKey string
+	hostname  string
+	username  string
+	password  string
+}
+
+func parseFluentSettings(config *DrainConfig) (*fluentSettings, error) {
+	var s fluentSettings
+	var err error
+
+	if config.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	s.host = config.Host
+	if _, _, err := net.SplitHostPort(s.host); err != nil {
+		s.host = net.JoinHostPort(s.host, DEFAULT_FLUENT_PORT)
+	}
+
+	// messages are tagged `<tagprefix>.<key>`, or just `<key>`.
+	s.tagPrefix = config.GetParam("tagprefix", "")
+
+	// With `ack`, every batch must be acknowledged by the server
+	// (require_ack_response), and is sent again if not.
+	s.ack, err = config.GetParamBool("ack", false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ack: %s", config.GetParam("ack", ""))
+	}
+	s.ackTimeout, err = config.GetParamDuration("acktimeout", DEFAULT_FLUENT_ACK_TIMEOUT)
+	if err != nil || s.ackTimeout <= 0 {
+		return nil, fmt.Errorf("invalid acktimeout: %s", config.GetParam("acktimeout", ""))
+	}
+
+	s.batchSize, err = config.GetParamInt("batch", DEFAULT_FLUENT_BATCH)
+	if err != nil || s.batchSize < 1 {
+		return nil, fmt.Errorf("invalid batch size: %s", config.GetParam("batch", ""))
+	}
+
+	s.writeTimeout, err = config.GetParamDuration(
+		"writetimeout", DEFAULT_WRITE_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid writetimeout: %s", err)
+	}
+
+	s.sharedKey = config.GetParam("sharedkey", "")
+	s.username = config.GetParam("username", "")
+	s.password = config.GetParam("password", "")
+	if s.sharedKey == "" && s.username != "" {
+		return nil, fmt.Errorf("username requires a sharedkey")
+	}
+	hostname, _ := os.Hostname()
+	s.hostname = config.GetParam("hostname", hostname)
+	return &s, nil
+}
+
+func (d *FluentDrain) Validate(config *DrainConfig) error {
+	_, err := parseFluentSettings(config)
+	return err
+}
+
+func (d *FluentDrain) TestConnection(config *DrainConfig) error {
+	settings, err := parseFluentSettings(config)
+	if err != nil {
+		return err
+	}
+	conn, err := dialFluent(settings)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (d *FluentDrain) Start(config *DrainConfig) {
+	defer d.Done()
+
+	settings, err := parseFluentSettings(config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	queue, err := NewMessageQueue(d.name, config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	log.Infof("[drain:%s] Attempting to connect to fluent %s ...",
+		d.name, settings.host)
+	conn, err := dialFluent(settings)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	log.Infof("[drain:%s] Successfully connected to fluent %s.",
+		d.name, settings.host)
+
+	source, unsubscribe := subscribe(config)
+	defer unsubscribe()
+
+	if err := queue.Start(source); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer queue.Stop()
+
+	go d.finishedStarting(true)
+
+	flushing := d.Flushing()
+	for {
+		select {
+		case <-flushing:
+			flushing = nil
+			queue.Close()
+		case msg, ok := <-queue.Ch:
+			if !ok {
+				// flushed
+				return
+			}
+			batch := []zmqpubsub.Message{msg}
+		collect:
+			for len(batch) < settings.batchSize {
+				select {
+				case msg, ok := <-queue.Ch:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, msg)
+				default:
+					break collect
+				}
+			}
+			conn, err = d.writeBatch(config, settings, conn, batch)
+			if err != nil {
+				for _, msg := range batch {
+					config.trace(msg, nil, err)
+				}
+				d.Kill(err)
+				return
+			}
+		case <-queue.Dying():
+			d.Kill(queue.Err())
+			return
+		case <-d.Dying():
+			return
+		}
+	}
+}
+
+// writeBatch forwards the messages, in one PackedForward message per
+// tag. A forward message that fails (or is not acknowledged) is sent
+// again once, over a new connection, which is returned.
+func (d *FluentDrain) writeBatch(
+	config *DrainConfig, settings *fluentSettings, conn *fluentConn,
+	batch []zmqpubsub.Message) (*fluentConn, error) {
+	var tags []string
+	entries := make(map[string]*bytes.Buffer)
+	counts := make(map[string]int)
+	payloads := make([][]byte, len(batch))
+	for idx, msg := range batch {
+		entry, err := fluentEntry(config, msg)
+		if err != nil {
+			return conn, err
+		}
+		payloads[idx] = entry
+		tag := msg.Key
+		if settings.tagPrefix != "" {
+			tag = settings.tagPrefix + "." + tag
+		}
+		if _, ok := entries[tag]; !ok {
+			tags = append(tags, tag)
+			entries[tag] = new(bytes.Buffer)
+		}
+		entries[tag].Write(entry)
+		counts[tag]++
+	}
+
+	for _, tag := range tags {
+		data, chunk, err := fluentForward(tag, entries[tag].Bytes(), counts[tag], settings.ack)
+		if err != nil {
+			return conn, err
+		}
+		if err = conn.forward(settings, data, chunk); err != nil {
+			log.Warnf("[drain:%s] Resending %d messages to fluent %s -- %s",
+				d.name, counts[tag], settings.host, err)
+			GetDrainStats(d.name).Add("fluent.retries", 1)
+			conn.Close()
+			if conn, err = dialFluent(settings); err != nil {
+				return nil, err
+			}
+			if err = conn.forward(settings, data, chunk); err != nil {
+				return conn, err
+			}
+		}
+	}
+	GetDrainStats(d.name).Add("fluent.forwarded", int64(len(batch)))
+	for idx, msg := range batch {
+		config.trace(msg, payloads[idx], nil)
+	}
+	return conn, nil
+}
+
+// fluentEntry returns the msgpack encoded [time, record] entry of the
+// message. The record is the message's (redacted) record or, if the
+// drain has a format, a record with only the formatted `message`.
+func fluentEntry(config *DrainConfig, msg zmqpubsub.Message) ([]byte, error) {
+	_, record, text, err := config.formatRecord(msg)
+	if err != nil {
+		return nil, err
+	}
+	t := recordTime(record)
+	if config.hasFormat() {
+		record = map[string]interface{}{"message": text}
+	}
+
+	var buf bytes.Buffer
+	msgpack.EncodeArrayHeader(&buf, 2)
+	msgpack.Encode(&buf, fluentEventTime(t))
+	if err := msgpack.Encode(&buf, record); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fluentEventTime returns the EventTime (ext type 0) of t, ie: its
+// seconds and nanoseconds as two big-endian uint32.
+func fluentEventTime(t time.Time) msgpack.Ext {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(t.Nanosecond()))
+	return msgpack.Ext{Type: 0, Data: data}
+}
+
+// fluentForward returns the PackedForward message of the given
+// entries, along with its chunk id if an ack is to be requested.
+func fluentForward(tag string, entries []byte, count int, ack bool) ([]byte, string, error) {
+	option := map[string]interface{}{"size": count}
+	var chunk string
+	if ack {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, "", err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		option["chunk"] = chunk
+	}
+	data, err := msgpack.Marshal([]interface{}{tag, entries, option})
+	return data, chunk, err
+}
+
+// fluentConn is a connection to a fluent server, authenticated if a
+// shared key is configured.
+type fluentConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialFluent(settings *fluentSettings) (*fluentConn, error) {
+	conn, err := net.DialTimeout("tcp", settings.host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &fluentConn{conn, bufio.NewReader(conn)}
+	if settings.sharedKey != "" {
+		if err = c.handshake(settings); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("fluent handshake with %s failed -- %v",
+				settings.host, err)
+		}
+	}
+	return c, nil
+}
+
+// handshake authenticates both ends using the shared key (and the
+// username and password, if the server asks for them): the server
+// sends HELO with a nonce, we reply with PING, and it with PONG.
+func (c *fluentConn) handshake(settings *fluentSettings) error {
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.SetDeadline(time.Time{})
+
+	helo, err := c.read("HELO", 2)
+	if err != nil {
+		return err
+	}
+	options, _ := helo[1].(map[string]interface{})
+	nonce := fluentBytes(options["nonce"])
+	auth := fluentBytes(options["auth"])
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return err
+	}
+	salt = []byte(hex.EncodeToString(salt))
+	var username, passwordDigest string
+	if len(auth) > 0 {
+		username = settings.username
+		passwordDigest = fluentDigest(auth, []byte(username), []byte(settings.password))
+	}
+	ping, err := msgpack.Marshal([]interface{}{
+		"PING", settings.hostname, salt,
+		fluentDigest(salt, []byte(settings.hostname), nonce, []byte(settings.sharedKey)),
+		username, passwordDigest})
+	if err != nil {
+		return err
+	}
+	if _, err = c.Write(ping); err != nil {
+		return err
+	}
+
+	pong, err := c.read("PONG", 5)
+	if err != nil {
+		return err
+	}
+	if ok, _ := pong[1].(bool); !ok {
+		return fmt.Errorf("authentication failed: %v", pong[2])
+	}
+	serverHostname := fluentBytes(pong[3])
+	expected := fluentDigest(salt, serverHostname, nonce, []byte(settings.sharedKey))
+	if string(fluentBytes(pong[4])) != expected {
+		return fmt.Errorf("shared key mismatch")
+	}
+	return nil
+}
+
+// read reads a handshake message of the given type and (minimum)
+// length.
+func (c *fluentConn) read(kind string, length int) ([]interface{}, error) {
+	v, err := msgpack.Decode(c.r)
+	if err != nil {
+		return nil, err
+	}
+	message, ok := v.([]interface{})
+	if !ok || len(message) < length || string(fluentBytes(message[0])) != kind {
+		return nil, fmt.Errorf("expected %s; got %v", kind, v)
+	}
+	return message, nil
+}
+
+// forward sends the forward message, waiting for it to be
+// acknowledged if chunk is set.
+func (c *fluentConn) forward(settings *fluentSettings, data []byte, chunk string) error {
+	if settings.writeTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(settings.writeTimeout))
+	}
+	if _, err := c.Write(data); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+	c.SetReadDeadline(time.Now().Add(settings.ackTimeout))
+	v, err := msgpack.Decode(c.r)
+	if err != nil {
+		return fmt.Errorf("no ack -- %v", err)
+	}
+	response, _ := v.(map[string]interface{})
+	if ack := string(fluentBytes(response["ack"])); ack != chunk {
+		return fmt.Errorf("unexpected ack %q (expected %q)", ack, chunk)
+	}
+	return nil
+}
+
+// fluentBytes returns the bytes of a str or bin value.
+func fluentBytes(v interface{}) []byte {
+	switch val := v.(type) {
+	case string:
+		return []byte(val)
+	case []byte:
+		return val
+	}
+	return nil
+}
+
+// fluentDigest returns the hex encoded SHA-512 digest of the
+// concatenated parts.
+func fluentDigest(parts ...[]byte) string {
+	h := sha512.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (d *FluentDrain) finishedStarting(success bool) {
+	d.initCh <- success
+}
+
+func (d *FluentDrain) WaitRunning() bool {
+	return <-d.initCh
+}
+
+func (d *FluentDrain) Stop() error {
+	d.Kill(nil)
+	return d.Wait()
+}
@@ -0,0 +1,204 @@
+package drain
+
+import (
+	"bufio"
+	"bytes"
+	"logyard/util/msgpack"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// fluentEvent is an entry received by fluentServer.
+type fluentEvent struct {
+	tag    string
+	time   msgpack.Ext
+	record map[string]interface{}
+}
+
+// fluentServer accepts forward protocol connections, authenticating
+// clients with sharedKey (and user/password) if set, and acking chunks
+// unless dropAck is set, in which case it instead closes the
+// connection once (without recording the events).
+type fluentServer struct {
+	listener  net.Listener
+	sharedKey string
+	user      string
+	password  string
+	dropAck   bool
+	events    chan fluentEvent
+}
+
+func (s *fluentServer) start(t *testing.T) {
+	var err error
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	s.events = make(chan fluentEvent, 10)
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			// one at a time, as the drain reconnects only after closing.
+			s.handle(t, conn)
+		}
+	}()
+}
+
+func (s *fluentServer) handle(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if s.sharedKey != "" {
+		nonce, auth := []byte("nonce"), []byte("auth")
+		helo, _ := msgpack.Marshal([]interface{}{"HELO", map[string]interface{}{
+			"nonce": nonce, "auth": auth, "keepalive": true}})
+		conn.Write(helo)
+		v, err := msgpack.Decode(r)
+		if err != nil {
+			return
+		}
+		ping := v.([]interface{})
+		salt := fluentBytes(ping[2])
+		ok := ping[3] == fluentDigest(salt, fluentBytes(ping[1]), nonce, []byte(s.sharedKey)) &&
+			ping[4] == s.user &&
+			ping[5] == fluentDigest(auth, []byte(s.user), []byte(s.password))
+		pong, _ := msgpack.Marshal([]interface{}{"PONG", ok, "", "server",
+			fluentDigest(salt, []byte("server"), nonce, []byte(s.sharedKey))})
+		conn.Write(pong)
+		if !ok {
+			return
+		}
+	}
+	for {
+		v, err := msgpack.Decode(r)
+		if err != nil {
+			return
+		}
+		forward := v.([]interface{})
+		option := forward[2].(map[string]interface{})
+		if s.dropAck {
+			s.dropAck = false
+			return
+		}
+		entries := bufio.NewReader(bytes.NewReader(forward[1].([]byte)))
+		for n := option["size"].(int64); n > 0; n-- {
+			entry, err := msgpack.Decode(entries)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s.events <- fluentEvent{
+				forward[0].(string),
+				entry.([]interface{})[0].(msgpack.Ext),
+				entry.([]interface{})[1].(map[string]interface{})}
+		}
+		if chunk, ok := option["chunk"]; ok {
+			ack, _ := msgpack.Marshal(map[string]interface{}{"ack": chunk})
+			conn.Write(ack)
+		}
+	}
+}
+
+func (s *fluentServer) receive(t *testing.T) fluentEvent {
+	select {
+	case event := <-s.events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for fluent events")
+	}
+	panic("unreachable")
+}
+
+func TestFluentDrain(t *testing.T) {
+	server := &fluentServer{
+		sharedKey: "secret", user: "logyard", password: "pass", dropAck: true}
+	server.start(t)
+	defer server.listener.Close()
+
+	cfg, err := ParseDrainUri("test.fluent", "fluent://"+server.listener.Addr().String()+
+		"?tagprefix=logyard&ack=true&sharedkey=secret&username=logyard&password=pass",
+		map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateDrainConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err = TestDrainConnection(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Source = make(chan zmqpubsub.Message)
+
+	d := NewFluentDrain("test.fluent")
+	go d.Start(cfg)
+	if !d.WaitRunning() {
+		t.Fatal(d.Wait())
+	}
+	defer d.Stop()
+
+	msg, err := SampleMessage("apptail", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Source <- msg
+
+	// The first forward is not acked, and so is sent again.
+	event := server.receive(t)
+	if event.tag != "logyard."+msg.Key {
+		t.Fatalf("unexpected tag: %s", event.tag)
+	}
+	if event.time.Type != 0 || len(event.time.Data) != 8 {
+		t.Fatalf("invalid event time: %+v", event.time)
+	}
+	if event.record["text"] != "sample apptail message #1" {
+		t.Fatalf("unexpected record: %+v", event.record)
+	}
+}
+
+func TestFluentSharedKeyMismatch(t *testing.T) {
+	server := &fluentServer{sharedKey: "secret"}
+	server.start(t)
+	defer server.listener.Close()
+
+	cfg, err := ParseDrainUri("test.fluent",
+		"fluent://"+server.listener.Addr().String()+"?sharedkey=wrong",
+		map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = TestDrainConnection(cfg); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+}
+
+func TestFluentEntryRedacted(t *testing.T) {
+	cfg, err := ParseDrainUri("test.fluentredact",
+		"fluent://localhost?redact=bearer", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ClearDrainStats(cfg.Name)
+	if cfg.Redactor, err = NewRedactor(cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fluentEntry(cfg, zmqpubsub.Message{
+		Key: "apptail.1", Value: `{"text":"Bearer abc123"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := msgpack.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := entry.([]interface{})[1].(map[string]interface{})
+	if record["text"] != "Bearer "+REDACTED {
+		t.Fatalf("record not redacted: %+v", record)
+	}
+	if n := GetDrainStats(cfg.Name).Get("redactions"); n != 1 {
+		t.Fatalf("expected 1 redaction; got %d", n)
+	}
+}
@@ -0,0 +1,427 @@
+package drain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hpcloud/log"
+	"github.com/hpcloud/zmqpubsub"
+	"gopkg.in/tomb.v1"
+)
+
+// Defaults for the gelf drain `chunksize` param, and port.
+const (
+	DEFAULT_GELF_CHUNK_SIZE = 1420 // suits most WAN links
+	DEFAULT_GELF_PORT       = "12201"
+)
+
+// GELF chunked UDP messages: each chunk starts with the magic bytes,
+// an 8 byte message id, and the chunk's sequence number and count.
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+const (
+	gelfChunkHeaderSize = 12
+	GELF_MAX_CHUNKS     = 128
+)
+
+// Record fields mapped onto standard GELF fields, rather than being
+// sent as additional (_-prefixed) fields.
+var gelfStandardFields = map[string]bool{
+	"text":       true,
+	"node_id":    true,
+	"unix_time":  true,
+	"human_time": true,
+	"syslog":     true,
+}
+
+// Syslog levels of the cloud event severities.
+var gelfEventLevels = map[string]int{
+	"ERROR":   3,
+	"WARNING": 4,
+	"INFO":    6,
+}
+
+// GelfDrain sends messages to Graylog (or any GELF input) over UDP,
+// compressed and chunked as needed, or over TCP, eg:
+// gelf://graylog:12201?transport=tcp
+type GelfDrain struct {
+	name   string
+	initCh chan bool
+	*flusher
+	tomb.Tomb
+}
+
+func NewGelfDrain(name string) DrainType {
+	var d GelfDrain
+	d.name = name
+	d.initCh = make(chan bool)
+	d.flusher = newFlusher()
+	return &d
+}
+
+// gelfSettings are the GelfDrain specific params.
+type gelfSettings struct {
+	host         string
+	transport    string // udp or tcp
+	compression  string // udp only: gzip, zlib or none
+	chunkSize    int
+	writeTimeout time.Duration
+}
+
+func parseGelfSettings(config *DrainConfig) (*gelfSettings, error) {
+	var s gelfSettings
+	var err error
+
+	if config.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	s.host = config.Host
+	if _, _, err := net.SplitHostPort(s.host); err != nil {
+		s.host = net.JoinHostPort(s.host, DEFAULT_GELF_PORT)
+	}
+
+	s.transport = config.GetParam("transport", "udp")
+	if !(s.transport == "udp" || s.transport == "tcp") {
+		return nil, fmt.Errorf("invalid transport: %s (must be udp or tcp)", s.transport)
+	}
+
+	// GELF over TCP does not support compression.
+	defaultCompression := "gzip"
+	if s.transport == "tcp" {
+		defaultCompression = "none"
+	}
+	s.compression = config.GetParam("compression", defaultCompression)
+	switch s.compression {
+	case "gzip", "zlib":
+		if s.transport == "tcp" {
+			return nil, fmt.Errorf("compression is not supported over tcp")
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf(
+			"invalid compression: %s (must be one of: gzip, zlib, none)", s.compression)
+	}
+
+	s.chunkSize, err = config.GetParamInt("chunksize", DEFAULT_GELF_CHUNK_SIZE)
+	if err != nil || s.chunkSize <= gelfChunkHeaderSize {
+		return nil, fmt.Errorf("invalid chunksize: %s", config.GetParam("chunksize", ""))
+	}
+
+	s.writeTimeout, err = config.GetParamDuration(
+		"writetimeout", DEFAULT_WRITE_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid writetimeout: %s", err)
+	}
+	return &s, nil
+}
+
+func (d *GelfDrain) Validate(config *DrainConfig) error {
+	_, err := parseGelfSettings(config)
+	return err
+}
+
+func (d *GelfDrain) TestConnection(config *DrainConfig) error {
+	settings, err := parseGelfSettings(config)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout(settings.transport, settings.host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (d *GelfDrain) Start(config *DrainConfig) {
+	defer d.Done()
+
+	settings, err := parseGelfSettings(config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	queue, err := NewMessageQueue(d.name, config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	log.Infof("[drain:%s] Attempting to connect to gelf %s://%s ...",
+		d.name, settings.transport, settings.host)
+
+	var conn net.Conn
+	dialer := NewNetDialer(settings.transport, settings.host, 10*time.Second)
+
+	select {
+	case conn = <-dialer.Ch:
+		if dialer.Error != nil {
+			d.Kill(dialer.Error)
+			go d.finishedStarting(false)
+			return
+		}
+	case <-d.Dying():
+		go dialer.WaitAndClose()
+		go d.finishedStarting(false)
+		return
+	}
+	defer conn.Close()
+
+	log.Infof("[drain:%s] Successfully connected to gelf %s://%s.",
+		d.name, settings.transport, settings.host)
+
+	source, unsubscribe := subscribe(config)
+	defer unsubscribe()
+
+	if err := queue.Start(source); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer queue.Stop()
+
+	go d.finishedStarting(true)
+
+	flushing := d.Flushing()
+	for {
+		select {
+		case <-flushing:
+			flushing = nil
+			queue.Close()
+		case msg, ok := <-queue.Ch:
+			if !ok {
+				// flushed
+				return
+			}
+			data, err := gelfMessage(config, msg)
+			if err != nil {
+				config.trace(msg, nil, err)
+				d.Kill(err)
+				return
+			}
+			if settings.writeTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(settings.writeTimeout))
+			}
+			if settings.transport == "tcp" {
+				_, err = conn.Write(append(data, 0))
+			} else {
+				err = d.writeUDP(conn, settings, data)
+			}
+			if err == errGelfTooLarge {
+				// Graylog would discard it anyway.
+				GetDrainStats(d.name).Add("gelf.toolarge", 1)
+				log.Errorf("[drain:%s] Skipping message (%s) -- %s",
+					d.name, msg.Key, err)
+				config.trace(msg, data, err)
+				continue
+			}
+			if err != nil {
+				config.trace(msg, data, err)
+				d.Kill(err)
+				return
+			}
+			config.trace(msg, data, nil)
+		case <-queue.Dying():
+			d.Kill(queue.Err())
+			return
+		case <-d.Dying():
+			return
+		}
+	}
+}
+
+var errGelfTooLarge = fmt.Errorf(
+	"message exceeds the maximum of %d gelf chunks", GELF_MAX_CHUNKS)
+
+// writeUDP compresses the GELF message, and sends it in one or more
+// chunked datagrams.
+func (d *GelfDrain) writeUDP(conn net.Conn, settings *gelfSettings, data []byte) error {
+	data, err := gelfCompress(data, settings.compression)
+	if err != nil {
+		return err
+	}
+	chunks, err := gelfChunks(data, settings.chunkSize)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err = conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gelfMessage returns the GELF (1.1) message for a systail, apptail
+// or event record: text (desc for events) becomes short_message
+// (formatted as per the drain's format, if any), node_id the host,
+// the syslog priority (or event severity) the level, and other
+// top-level fields additional fields (eg: _app_name).
+func gelfMessage(config *DrainConfig, msg zmqpubsub.Message) ([]byte, error) {
+	msg, record, short, err := config.formatRecord(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	gelf := map[string]interface{}{
+		"version":   "1.1",
+		"host":      gelfHost(record),
+		"timestamp": gelfTimestamp(record),
+		"level":     gelfLevel(record),
+		"_key":      msg.Key}
+
+	if short != "" {
+		gelf["short_message"] = short
+	} else if text := recordText(record); text != "" {
+		gelf["short_message"] = text
+	} else {
+		// short_message is mandatory.
+		gelf["short_message"] = msg.Key
+	}
+
+	keys := make([]string, 0, len(record))
+	for key, _ := range record {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if gelfStandardFields[key] || key == "id" || key == textField(record) {
+			// _id is reserved; and the text (desc of events) is
+			// the short_message.
+			continue
+		}
+		switch value := record[key].(type) {
+		case string, float64:
+			gelf["_"+key] = value
+		case bool:
+			gelf["_"+key] = fmt.Sprintf("%v", value)
+		case nil:
+		default:
+			// Additional fields must be strings or numbers.
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			gelf["_"+key] = string(data)
+		}
+	}
+	return json.Marshal(gelf)
+}
+
+func gelfHost(record map[string]interface{}) string {
+	if nodeID, ok := record["node_id"].(string); ok && nodeID != "" {
+		return nodeID
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// gelfTimestamp returns the record's time in (fractional) seconds
+// since the epoch, preferring the precise syslog time.
+func gelfTimestamp(record map[string]interface{}) float64 {
+	if syslog, ok := record["syslog"].(map[string]interface{}); ok {
+		if s, ok := syslog["time"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+			}
+		}
+	}
+	if unixTime, ok := record["unix_time"].(float64); ok {
+		return unixTime
+	}
+	return float64(time.Now().UnixNano()/int64(time.Millisecond)) / 1000
+}
+
+// gelfLevel returns the syslog level (severity) of the record.
+func gelfLevel(record map[string]interface{}) int {
+	if syslog, ok := record["syslog"].(map[string]interface{}); ok {
+		if priority, ok := syslog["priority"].(float64); ok {
+			return int(priority) & 7
+		}
+	}
+	if severity, ok := record["severity"].(string); ok {
+		if level, ok := gelfEventLevels[severity]; ok {
+			return level
+		}
+	}
+	return 6 // informational
+}
+
+func gelfCompress(data []byte, compression string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch compression {
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "zlib":
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// gelfChunks splits data into GELF chunks of at most chunkSize bytes
+// (including the chunk header), unless it fits in a single datagram.
+func gelfChunks(data []byte, chunkSize int) ([][]byte, error) {
+	if len(data) <= chunkSize {
+		return [][]byte{data}, nil
+	}
+	payloadSize := chunkSize - gelfChunkHeaderSize
+	count := (len(data) + payloadSize - 1) / payloadSize
+	if count > GELF_MAX_CHUNKS {
+		return nil, errGelfTooLarge
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, 0, count)
+	for seq := 0; seq < count; seq++ {
+		end := (seq + 1) * payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-seq*payloadSize)
+		chunk = append(chunk, gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(seq), byte(count))
+		chunk = append(chunk, data[seq*payloadSize:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func (d *GelfDrain) finishedStarting(success bool) {
+	d.initCh <- success
+}
+
+func (d *GelfDrain) WaitRunning() bool {
+	return <-d.initCh
+}
+
+func (d *GelfDrain) Stop() error {
+	d.Kill(nil)
+	return d.Wait()
+}
@@ -0,0 +1,197 @@
+package drain
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// startGelfDrain starts a gelf drain for uri, returning it along with
+// its message source.
+func startGelfDrain(t *testing.T, uri string) (DrainType, chan zmqpubsub.Message) {
+	cfg, err := ParseDrainUri("test.gelf", uri, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateDrainConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Source = make(chan zmqpubsub.Message)
+	d := NewGelfDrain("test.gelf")
+	go d.Start(cfg)
+	if !d.WaitRunning() {
+		t.Fatal(d.Wait())
+	}
+	return d, cfg.Source
+}
+
+func TestGelfUDPChunked(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, compression := range []string{"gzip", "zlib"} {
+		d, source := startGelfDrain(t, "gelf://"+conn.LocalAddr().String()+
+			"?chunksize=64&compression="+compression)
+		msg, err := SampleMessage("apptail", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source <- msg
+
+		// Reassemble the chunks, which arrive in order on loopback.
+		var data []byte
+		buf := make([]byte, 1024)
+		for seq, count := 0, 1; seq < count; seq++ {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 64 || !bytes.HasPrefix(buf, gelfChunkMagic) || int(buf[10]) != seq {
+				t.Fatalf("invalid chunk #%d: %x", seq, buf[:n])
+			}
+			count = int(buf[11])
+			data = append(data, buf[gelfChunkHeaderSize:n]...)
+		}
+		d.Stop()
+
+		var r io.Reader
+		if compression == "gzip" {
+			r, err = gzip.NewReader(bytes.NewReader(data))
+		} else {
+			r, err = zlib.NewReader(bytes.NewReader(data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		var gelf map[string]interface{}
+		if err = json.Unmarshal(data, &gelf); err != nil {
+			t.Fatal(err)
+		}
+		if gelf["version"] != "1.1" ||
+			gelf["short_message"] != "sample apptail message #1" ||
+			gelf["level"] != float64(6) ||
+			gelf["_app_name"] != "sample-app" ||
+			gelf["_instance_index"] != float64(0) ||
+			gelf["_key"] != "apptail.1" {
+			t.Fatalf("unexpected gelf message: %s", data)
+		}
+		if _, ok := gelf["_text"]; ok {
+			t.Fatalf("text should only be in short_message: %s", data)
+		}
+	}
+}
+
+func TestGelfTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d, source := startGelfDrain(t, "gelf://"+ln.Addr().String()+
+		"?transport=tcp&format={{.name}}: {{.text}}")
+	defer d.Stop()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for seq := 1; seq <= 2; seq++ {
+		msg, err := SampleMessage("systail", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source <- msg
+	}
+	r := bufio.NewReader(conn)
+	for seq := 1; seq <= 2; seq++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		data, err := r.ReadBytes(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gelf map[string]interface{}
+		if err = json.Unmarshal(data[:len(data)-1], &gelf); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(gelf["short_message"].(string), "logyard: sample systail") {
+			t.Fatalf("unexpected gelf message: %s", data)
+		}
+	}
+}
+
+func TestGelfChunkLimit(t *testing.T) {
+	if _, err := gelfChunks(make([]byte, 129*52), 64); err != errGelfTooLarge {
+		t.Fatalf("expected too many chunks to be rejected; got %v", err)
+	}
+	if chunks, err := gelfChunks(make([]byte, 128*52), 64); err != nil || len(chunks) != 128 {
+		t.Fatalf("expected 128 chunks; got %d (%v)", len(chunks), err)
+	}
+}
+
+func TestGelfEventMessage(t *testing.T) {
+	cfg, err := ParseDrainUri("test.gelf", "gelf://localhost", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := gelfMessage(cfg, zmqpubsub.Message{Key: "event.dea_start",
+		Value: `{"type":"dea_start","desc":"Started app foo","severity":"WARNING"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gelf map[string]interface{}
+	if err = json.Unmarshal(data, &gelf); err != nil {
+		t.Fatal(err)
+	}
+	if gelf["short_message"] != "Started app foo" || gelf["level"] != float64(4) {
+		t.Fatalf("unexpected gelf message: %s", data)
+	}
+	if _, ok := gelf["_desc"]; ok || gelf["_type"] != "dea_start" {
+		t.Fatalf("unexpected additional fields: %s", data)
+	}
+}
+
+func TestGelfRedactsOnce(t *testing.T) {
+	cfg, err := ParseDrainUri("test.gelfredact",
+		"gelf://localhost?format={{.text}}&redact=bearer", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ClearDrainStats(cfg.Name)
+	if cfg.Redactor, err = NewRedactor(cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := gelfMessage(cfg, zmqpubsub.Message{Key: "apptail.1",
+		Value: `{"text":"Bearer abc123","app_name":"Bearer xyz"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gelf map[string]interface{}
+	if err = json.Unmarshal(data, &gelf); err != nil {
+		t.Fatal(err)
+	}
+	if gelf["short_message"] != "Bearer "+REDACTED || gelf["_app_name"] != "Bearer "+REDACTED {
+		t.Fatalf("gelf message not redacted: %s", data)
+	}
+	if n := GetDrainStats(cfg.Name).Get("redactions"); n != 2 {
+		t.Fatalf("expected 2 redactions; got %d", n)
+	}
+}
@@ -1,7 +1,7 @@
 package drain
 
 import (
-	"logyard"
+	"fmt"
 	"net"
 	"time"
 
@@ -9,10 +9,19 @@ import (
 	"gopkg.in/tomb.v1"
 )
 
+// Defaults for the `writetimeout`, `keepalive` and `probe` params;
+// a value of 0 disables the corresponding feature.
+const (
+	DEFAULT_WRITE_TIMEOUT  = 30 * time.Second
+	DEFAULT_KEEPALIVE      = 30 * time.Second
+	DEFAULT_PROBE_INTERVAL = 10 * time.Second
+)
+
 // IPConnDrain is a drain based on net.IPConn
 type IPConnDrain struct {
 	name   string
 	initCh chan bool
+	*flusher
 	tomb.Tomb
 }
 
@@ -20,14 +29,70 @@ func NewIPConnDrain(name string) DrainType {
 	var d IPConnDrain
 	d.name = name
 	d.initCh = make(chan bool)
+	d.flusher = newFlusher()
 	return &d
 }
 
+// ipConnSettings are the IPConnDrain specific params.
+type ipConnSettings struct {
+	writeTimeout  time.Duration
+	keepalive     time.Duration
+	probeInterval time.Duration
+}
+
+func parseIPConnSettings(config *DrainConfig) (*ipConnSettings, error) {
+	if !(config.Scheme == "udp" || config.Scheme == "tcp") {
+		return nil, fmt.Errorf("Invalid scheme: %s", config.Scheme)
+	}
+	if config.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+
+	var s ipConnSettings
+	var err error
+	s.writeTimeout, err = config.GetParamDuration(
+		"writetimeout", DEFAULT_WRITE_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid writetimeout: %s", err)
+	}
+	s.keepalive, err = config.GetParamDuration("keepalive", DEFAULT_KEEPALIVE)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keepalive: %s", err)
+	}
+	s.probeInterval, err = config.GetParamDuration(
+		"probe", DEFAULT_PROBE_INTERVAL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid probe interval: %s", err)
+	}
+	return &s, nil
+}
+
+func (d *IPConnDrain) Validate(config *DrainConfig) error {
+	_, err := parseIPConnSettings(config)
+	return err
+}
+
+func (d *IPConnDrain) TestConnection(config *DrainConfig) error {
+	conn, err := net.DialTimeout(config.Scheme, config.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func (d *IPConnDrain) Start(config *DrainConfig) {
 	defer d.Done()
 
-	if !(config.Scheme == "udp" || config.Scheme == "tcp") {
-		d.Killf("Invalid scheme: %s", config.Scheme)
+	settings, err := parseIPConnSettings(config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	queue, err := NewMessageQueue(d.name, config)
+	if err != nil {
+		d.Kill(err)
 		go d.finishedStarting(false)
 		return
 	}
@@ -64,30 +129,100 @@ func (d *IPConnDrain) Start(config *DrainConfig) {
 	log.Infof("[drain:%s] Successfully connected to %s://%s.",
 		d.name, config.Scheme, config.Host)
 
-	sub := logyard.Broker.Subscribe(config.Filters...)
-	defer sub.Stop()
+	if tcpConn, ok := conn.(*net.TCPConn); ok && settings.keepalive > 0 {
+		if err = tcpConn.SetKeepAlive(true); err == nil {
+			err = tcpConn.SetKeepAlivePeriod(settings.keepalive)
+		}
+		if err != nil {
+			d.Kill(err)
+			go d.finishedStarting(false)
+			return
+		}
+	}
+
+	// The probe reports a connection that was closed or reset by the
+	// peer, which would otherwise go unnoticed until the next write.
+	probeCh := make(chan error, 1)
+	if config.Scheme == "tcp" && settings.probeInterval > 0 {
+		go d.probe(conn, settings.probeInterval, probeCh)
+	}
+
+	source, unsubscribe := subscribe(config)
+	defer unsubscribe()
+
+	if err := queue.Start(source); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer queue.Stop()
 
 	go d.finishedStarting(true)
 
+	flushing := d.Flushing()
 	for {
 		select {
-		case msg := <-sub.Ch:
+		case <-flushing:
+			flushing = nil
+			queue.Close()
+		case msg, ok := <-queue.Ch:
+			if !ok {
+				// flushed
+				return
+			}
 			data, err := config.FormatJSON(msg)
 			if err != nil {
+				config.trace(msg, nil, err)
 				d.Kill(err)
 				return
 			}
+			if settings.writeTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(settings.writeTimeout))
+			}
 			_, err = conn.Write(data)
 			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					err = fmt.Errorf(
+						"connection stalled; write did not complete in %v",
+						settings.writeTimeout)
+				}
+				config.trace(msg, data, err)
 				d.Kill(err)
 				return
 			}
+			config.trace(msg, data, nil)
+		case err := <-probeCh:
+			d.Kill(err)
+			return
+		case <-queue.Dying():
+			d.Kill(queue.Err())
+			return
 		case <-d.Dying():
 			return
 		}
 	}
 }
 
+// probe periodically reads from the connection, which a drain peer is
+// not expected to write to, to detect the connection being closed.
+// It exits, sending an error to errCh, as soon as the read fails for
+// a reason other than a timeout (including the drain closing conn).
+func (d *IPConnDrain) probe(conn net.Conn, interval time.Duration, errCh chan error) {
+	buf := make([]byte, 512)
+	for {
+		conn.SetReadDeadline(time.Now().Add(interval))
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			continue
+		}
+		errCh <- fmt.Errorf("connection lost -- %v", err)
+		return
+	}
+}
+
 func (d *IPConnDrain) finishedStarting(success bool) {
 	d.initCh <- success
 }
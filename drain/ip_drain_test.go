@@ -0,0 +1,74 @@
+package drain
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeDetectsClosedConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewIPConnDrain("test.probe").(*IPConnDrain)
+	errCh := make(chan error, 1)
+	go d.probe(conn, 10*time.Millisecond, errCh)
+
+	// An idle, but open, connection is alive.
+	select {
+	case err := <-errCh:
+		t.Fatalf("probe failed on a live connection: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	peer.Close()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("probe did not detect the closed connection")
+	}
+}
+
+func TestValidateAndTestConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg, err := ParseDrainUri(
+		"test.check", "tcp://"+ln.Addr().String()+"/", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateDrainConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err = TestDrainConnection(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Params["writetimeout"] = "soon"
+	if err = ValidateDrainConfig(cfg); err == nil {
+		t.Fatal("expected an error for an invalid writetimeout")
+	}
+	cfg.Params["writetimeout"] = "1s"
+	cfg.Params["overflow"] = "sometimes"
+	if err = ValidateDrainConfig(cfg); err == nil {
+		t.Fatal("expected an error for an invalid overflow policy")
+	}
+}
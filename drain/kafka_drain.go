@@ -0,0 +1,308 @@
+package drain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"logyard/util/kafka"
+	"logyard/util/templatefuncs"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hpcloud/log"
+	"github.com/hpcloud/zmqpubsub"
+	"gopkg.in/tomb.v1"
+)
+
+// Defaults for the kafka drain `batch` and `timeout` params.
+const (
+	DEFAULT_KAFKA_BATCH   = 100
+	DEFAULT_KAFKA_TIMEOUT = 10 * time.Second
+)
+
+// KafkaDrain produces messages to a Kafka topic, eg:
+// kafka://broker1:9092,broker2:9092/logs?key={{.app_id}}&acks=all
+type KafkaDrain struct {
+	name   string
+	initCh chan bool
+	*flusher
+	tomb.Tomb
+}
+
+func NewKafkaDrain(name string) DrainType {
+	var d KafkaDrain
+	d.name = name
+	d.initCh = make(chan bool)
+	d.flusher = newFlusher()
+	return &d
+}
+
+// kafkaSettings are the KafkaDrain specific params.
+type kafkaSettings struct {
+	brokers   []string
+	topic     string
+	key       *template.Template // partition key; nil for round-robin
+	producer  kafka.Config
+	batchSize int
+	linger    time.Duration
+}
+
+func parseKafkaSettings(name string, config *DrainConfig) (*kafkaSettings, error) {
+	var s kafkaSettings
+	var err error
+
+	if config.Host == "" {
+		return nil, fmt.Errorf("missing brokers")
+	}
+	s.brokers = strings.Split(config.Host, ",")
+	s.topic = strings.Trim(config.Path, "/")
+	if s.topic == "" || strings.Contains(s.topic, "/") {
+		return nil, fmt.Errorf("invalid topic: %s", config.Path)
+	}
+
+	// messages with the same `key` (a template evaluated against the
+	// record) go to the same partition.
+	if key := config.GetParam("key", ""); key != "" {
+		s.key, err = templatefuncs.New(name + ":key").Option("missingkey=error").Parse(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key template -- %s", err)
+		}
+	}
+
+	s.producer.ClientID = "logyard"
+	switch acks := config.GetParam("acks", "1"); acks {
+	case "0":
+		s.producer.Acks = kafka.ACKS_NONE
+	case "1":
+		s.producer.Acks = kafka.ACKS_LEADER
+	case "all", "-1":
+		s.producer.Acks = kafka.ACKS_ALL
+	default:
+		return nil, fmt.Errorf("invalid acks: %s (must be one of: 0, 1, all)", acks)
+	}
+
+	switch compression := config.GetParam("compression", "none"); compression {
+	case "none":
+		s.producer.Compression = kafka.COMPRESSION_NONE
+	case "gzip":
+		s.producer.Compression = kafka.COMPRESSION_GZIP
+	default:
+		return nil, fmt.Errorf(
+			"unsupported compression: %s (must be one of: none, gzip)", compression)
+	}
+
+	s.producer.Timeout, err = config.GetParamDuration("timeout", DEFAULT_KAFKA_TIMEOUT)
+	if err != nil || s.producer.Timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout: %s", config.GetParam("timeout", ""))
+	}
+
+	// Up to `batch` messages are sent in a single produce request,
+	// waiting up to `linger` for the batch to fill up.
+	s.batchSize, err = config.GetParamInt("batch", DEFAULT_KAFKA_BATCH)
+	if err != nil || s.batchSize < 1 {
+		return nil, fmt.Errorf("invalid batch size: %s", config.GetParam("batch", ""))
+	}
+	s.linger, err = config.GetParamDuration("linger", 0)
+	if err != nil || s.linger < 0 {
+		return nil, fmt.Errorf("invalid linger: %s", config.GetParam("linger", ""))
+	}
+	return &s, nil
+}
+
+func (d *KafkaDrain) Validate(config *DrainConfig) error {
+	_, err := parseKafkaSettings(d.name, config)
+	return err
+}
+
+func (d *KafkaDrain) TestConnection(config *DrainConfig) error {
+	settings, err := parseKafkaSettings(d.name, config)
+	if err != nil {
+		return err
+	}
+	producer := kafka.NewProducer(settings.brokers, settings.producer)
+	defer producer.Close()
+	_, err = producer.Partitions(settings.topic)
+	return err
+}
+
+func (d *KafkaDrain) Start(config *DrainConfig) {
+	defer d.Done()
+
+	settings, err := parseKafkaSettings(d.name, config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	queue, err := NewMessageQueue(d.name, config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	log.Infof("[drain:%s] Attempting to connect to kafka %s ...",
+		d.name, config.Host)
+	producer := kafka.NewProducer(settings.brokers, settings.producer)
+	defer producer.Close()
+	if _, err = producer.Partitions(settings.topic); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	log.Infof("[drain:%s] Successfully connected to kafka %s.",
+		d.name, config.Host)
+
+	source, unsubscribe := subscribe(config)
+	defer unsubscribe()
+
+	if err := queue.Start(source); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer queue.Stop()
+
+	go d.finishedStarting(true)
+
+	// for round-robin partitioning of messages without a key.
+	next := 0
+
+	flushing := d.Flushing()
+	for {
+		select {
+		case <-flushing:
+			flushing = nil
+			queue.Close()
+		case msg, ok := <-queue.Ch:
+			if !ok {
+				// flushed
+				return
+			}
+			batch := []zmqpubsub.Message{msg}
+			var linger <-chan time.Time
+			if settings.linger > 0 {
+				linger = time.After(settings.linger)
+			}
+		collect:
+			for len(batch) < settings.batchSize {
+				if linger == nil {
+					select {
+					case msg, ok := <-queue.Ch:
+						if !ok {
+							break collect
+						}
+						batch = append(batch, msg)
+					default:
+						break collect
+					}
+				} else {
+					select {
+					case msg, ok := <-queue.Ch:
+						if !ok {
+							break collect
+						}
+						batch = append(batch, msg)
+					case <-linger:
+						break collect
+					}
+				}
+			}
+			next, err = d.writeBatch(config, settings, producer, batch, next)
+			if err != nil {
+				for _, msg := range batch {
+					config.trace(msg, nil, err)
+				}
+				d.Kill(err)
+				return
+			}
+		case <-queue.Dying():
+			d.Kill(queue.Err())
+			return
+		case <-d.Dying():
+			return
+		}
+	}
+}
+
+// writeBatch produces the given messages in a single request (per
+// partition leader), returning the next round-robin partition.
+func (d *KafkaDrain) writeBatch(
+	config *DrainConfig, settings *kafkaSettings, producer *kafka.Producer,
+	batch []zmqpubsub.Message, next int) (int, error) {
+	partitions, err := producer.Partitions(settings.topic)
+	if err != nil {
+		return next, err
+	}
+
+	messages := make(map[int32][]kafka.Message)
+	payloads := make([][]byte, len(batch))
+	now := time.Now()
+	for idx, msg := range batch {
+		// The key may be derived from the record, which is redacted
+		// only once.
+		msg, err := config.redact(msg)
+		if err != nil {
+			return next, err
+		}
+		data, err := config.format(msg)
+		if err != nil {
+			return next, err
+		}
+		payloads[idx] = data
+		record := kafka.Message{Value: bytes.TrimSuffix(data, []byte("\n")), Time: now}
+
+		var partition int32
+		if record.Key = d.key(settings, msg); record.Key != nil {
+			partition = partitions[kafka.HashPartition(record.Key, len(partitions))]
+		} else {
+			partition = partitions[next%len(partitions)]
+			next++
+		}
+		messages[partition] = append(messages[partition], record)
+	}
+
+	if err = producer.Produce(settings.topic, messages); err != nil {
+		return next, err
+	}
+	GetDrainStats(d.name).Add("kafka.produced", int64(len(batch)))
+	for idx, msg := range batch {
+		config.trace(msg, payloads[idx], nil)
+	}
+	return next, nil
+}
+
+// key returns the partition key of the (redacted) message, which is
+// nil if no `key` param was specified or if the record lacks the
+// fields it uses.
+func (d *KafkaDrain) key(settings *kafkaSettings, msg zmqpubsub.Message) []byte {
+	if settings.key == nil {
+		return nil
+	}
+	record := make(map[string]interface{})
+	var buf bytes.Buffer
+	err := json.Unmarshal([]byte(msg.Value), &record)
+	if err == nil {
+		err = settings.key.Execute(&buf, record)
+	}
+	if err != nil {
+		GetDrainStats(d.name).Add("kafka.nokey", 1)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func (d *KafkaDrain) finishedStarting(success bool) {
+	d.initCh <- success
+}
+
+func (d *KafkaDrain) WaitRunning() bool {
+	return <-d.initCh
+}
+
+func (d *KafkaDrain) Stop() error {
+	d.Kill(nil)
+	return d.Wait()
+}
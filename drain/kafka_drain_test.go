@@ -0,0 +1,138 @@
+package drain
+
+import (
+	"logyard/util/kafka"
+	kafkatest "logyard/util/kafka/test"
+	"testing"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+func TestKafkaDrain(t *testing.T) {
+	broker, err := kafkatest.NewBroker("logs", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	cfg, err := ParseDrainUri("test.kafka",
+		"kafka://"+broker.Addr()+"/logs?key={{.app_id}}&acks=all&compression=gzip&format={{.text}}",
+		map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateDrainConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err = TestDrainConnection(cfg); err != nil {
+		t.Fatal(err)
+	}
+	traced := make(chan error, 3)
+	cfg.Source = make(chan zmqpubsub.Message)
+	cfg.Trace = func(msg zmqpubsub.Message, data []byte, err error) {
+		traced <- err
+	}
+
+	d := NewKafkaDrain("test.kafka")
+	go d.Start(cfg)
+	if !d.WaitRunning() {
+		t.Fatal(d.Wait())
+	}
+	defer d.Stop()
+
+	for seq := 1; seq <= 2; seq++ {
+		msg, err := SampleMessage("apptail", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Source <- msg
+	}
+	// Systail records have no app_id, and so no key.
+	msg, err := SampleMessage("systail", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Source <- msg
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-traced:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for messages to be produced")
+		}
+	}
+
+	// Messages of the same app go to the same partition.
+	partition := int32(kafka.HashPartition([]byte("1"), 4))
+	records := broker.Records(partition)
+	if len(records) < 2 || string(records[0].Key) != "1" ||
+		string(records[0].Value) != "sample apptail message #1" ||
+		string(records[1].Value) != "sample apptail message #2" {
+		t.Fatalf("unexpected records in partition %d: %+v", partition, records)
+	}
+	if broker.Count() != 3 {
+		t.Fatalf("expected 3 records; got %d", broker.Count())
+	}
+}
+
+func TestKafkaSettings(t *testing.T) {
+	for _, uri := range []string{
+		"kafka://localhost/",
+		"kafka:///logs",
+		"kafka://localhost/logs?acks=2",
+		"kafka://localhost/logs?compression=snappy",
+		"kafka://localhost/logs?batch=0",
+		"kafka://localhost/logs?key={{.app_id",
+	} {
+		cfg, err := ParseDrainUri("test.kafka", uri, map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ValidateDrainConfig(cfg); err == nil {
+			t.Errorf("expected %s to be invalid", uri)
+		}
+	}
+}
+
+func TestKafkaRedactsOnce(t *testing.T) {
+	broker, err := kafkatest.NewBroker("logs", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	cfg, err := ParseDrainUri("test.kafkaredact",
+		"kafka://"+broker.Addr()+"/logs?key={{.text}}&redact=bearer", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ClearDrainStats(cfg.Name)
+	if cfg.Redactor, err = NewRedactor(cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := parseKafkaSettings(cfg.Name, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := kafka.NewProducer(settings.brokers, settings.producer)
+	defer producer.Close()
+
+	d := NewKafkaDrain(cfg.Name).(*KafkaDrain)
+	_, err = d.writeBatch(cfg, settings, producer, []zmqpubsub.Message{
+		{Key: "apptail.1", Value: `{"text":"Bearer abc123"}`}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := broker.Records(0)
+	if len(records) != 1 || string(records[0].Key) != "Bearer "+REDACTED ||
+		string(records[0].Value) != `{"text":"Bearer `+REDACTED+`"}` {
+		t.Fatalf("record not redacted: %+v", records)
+	}
+	if n := GetDrainStats(cfg.Name).Get("redactions"); n != 1 {
+		t.Fatalf("expected 1 redaction; got %d", n)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"logyard/util/retry"
 	"logyard/util/state"
 	"logyard/util/statecache"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,17 +17,87 @@ import (
 
 const configKey = "/proc/logyard/config/"
 
+// How often to check for drains whose lease expired.
+const DRAIN_EXPIRY_INTERVAL = 10 * time.Second
+
+// How often to re-check the placement of drains; leaders renew their
+// lease, and others check if it expired, thrice per lease period.
+const PLACEMENT_INTERVAL = LEADER_LEASE / 3
+
+// Commands handled by the drain manager loop.
+const (
+	cmdStart    = iota
+	cmdStop     // stop a drain
+	cmdRestart  // restart drains, with a fresh retryer
+	cmdReload   // apply a new set of configured drains
+	cmdPlace    // re-check the placement of the configured drains
+	cmdQuery    // run a function with access to the manager state
+	cmdShutdown // flush and stop all drains, and exit the loop
+)
+
+// command is a request to the drain manager loop. done is closed
+// once the command has been handled.
+type command struct {
+	action  int
+	name    string
+	uri     string
+	retryer retry.Retryer
+	clear   bool     // cmdStop: also clear the cached state
+	names   []string // cmdRestart: drains to restart (all if empty)
+	state   string   // cmdRestart: only restart drains in this state
+	result  []string // cmdRestart: the restarted drains
+	err     error
+	drains  map[string]string // cmdReload
+	timeout time.Duration     // cmdShutdown: how long to wait for flushing
+	query   func()            // cmdQuery
+	done    chan bool
+}
+
+// leaseElector elects the node running a drain placed on `one` node
+// (see Elector).
+type leaseElector interface {
+	Campaign(name string) (bool, error)
+	Resign(name string) error
+	Forget(name string) error
+}
+
+// leaseStore tracks the leases of drains, as renewed (see
+// logyard.DrainLeases).
+type leaseStore interface {
+	Expired(name string, meta logyard.DrainMeta, now time.Time) (bool, error)
+	DeleteExpired(now time.Time) ([]string, error)
+}
+
+// stateStore caches the state of drains, for `logyard-cli status`.
+type stateStore interface {
+	SetState(name string, state state.State, rev int64)
+	Clear(name string)
+}
+
+// DrainManager starts and stops drains as per the config. Its state
+// is owned by a single goroutine (loop), to which the methods below
+// send commands; they return once the command has been handled, or
+// immediately if the manager was shut down.
 type DrainManager struct {
-	mux        sync.Mutex // mutex to protect Start/Stop
-	stopCh     chan bool
+	commands   chan *command
+	done       chan bool // closed when the loop exits
 	stmMap     map[string]*state.StateMachine
-	stateCache *statecache.StateCache
+	procMap    map[string]*DrainProcess
+	startMap   map[string]time.Time // when the drains were started
+	drains     map[string]string    // configured drains, by name
+	iteration  int                  // number of config reloads
+	nodeIP     string
+	stateCache stateStore
+	elector    leaseElector         // elects the node running drains placed on `one` node
+	renewed    map[string]time.Time // when we last (re)gained the leadership of drains
+	failed     map[string]string    // uri of drains that could not be created, by name
+	leases     leaseStore
+	// Replaced by tests, which run without the logyard config.
+	newProcess func(name, uri string) (*DrainProcess, error)
+	newRetryer func(name string) retry.Retryer
 }
 
 func NewDrainManager() *DrainManager {
-	manager := new(DrainManager)
-	manager.stopCh = make(chan bool)
-	manager.stmMap = make(map[string]*state.StateMachine)
 	client, err := server.NewRedisClientRetry(
 		server.GetClusterConfig().MbusIp+":6464",
 		"",
@@ -35,29 +106,187 @@ func NewDrainManager() *DrainManager {
 	if err != nil {
 		log.Fatalf("Unable to connect to applog_redis; %v", err)
 	}
-	manager.stateCache = &statecache.StateCache{
+	nodeIP := server.LocalIPMust()
+	manager := newDrainManager(nodeIP, &statecache.StateCache{
 		"logyard:drainstatus:",
-		server.LocalIPMust(),
+		nodeIP,
+		client})
+	manager.elector = &Elector{
+		"logyard:drainleader:",
+		nodeIP,
+		LEADER_LEASE,
 		client}
+	manager.leases = &logyard.DrainLeases{Prefix: logyard.DRAIN_LEASE_PREFIX, Client: client}
+	go manager.loop()
 	return manager
 }
 
-// Stop stops the drain manager including running drains
+// newDrainManager returns a drain manager whose loop is yet to be
+// started.
+func newDrainManager(nodeIP string, stateCache stateStore) *DrainManager {
+	return &DrainManager{
+		commands:   make(chan *command),
+		done:       make(chan bool),
+		stmMap:     make(map[string]*state.StateMachine),
+		procMap:    make(map[string]*DrainProcess),
+		startMap:   make(map[string]time.Time),
+		drains:     make(map[string]string),
+		renewed:    make(map[string]time.Time),
+		failed:     make(map[string]string),
+		nodeIP:     nodeIP,
+		stateCache: stateCache,
+		newProcess: NewDrainProcess,
+		newRetryer: NewRetryerForDrain}
+}
+
+// send sends the command to the loop and waits for it to be handled,
+// returning false if the manager was shut down.
+func (manager *DrainManager) send(cmd *command) bool {
+	cmd.done = make(chan bool)
+	select {
+	case manager.commands <- cmd:
+	case <-manager.done:
+		return false
+	}
+	<-cmd.done
+	return true
+}
+
+func (manager *DrainManager) loop() {
+	defer close(manager.done)
+	for cmd := range manager.commands {
+		switch cmd.action {
+		case cmdStart:
+			manager.startDrain(cmd.name, cmd.uri, cmd.retryer)
+		case cmdStop:
+			manager.stopDrain(cmd.name, cmd.clear)
+		case cmdRestart:
+			cmd.result, cmd.err = manager.restartDrains(cmd.names, cmd.state)
+		case cmdReload:
+			manager.reload(cmd.drains)
+		case cmdPlace:
+			manager.placeDrains()
+		case cmdQuery:
+			cmd.query()
+		case cmdShutdown:
+			manager.shutdown(cmd.timeout)
+			close(cmd.done)
+			return
+		}
+		close(cmd.done)
+	}
+}
+
+// Stop stops the drain manager including running drains, without
+// waiting for them to flush.
 func (manager *DrainManager) Stop() {
-	manager.mux.Lock()
-	defer manager.mux.Unlock()
+	manager.Shutdown(0)
+}
+
+// Shutdown stops the drain manager, first giving the running drains
+// up to timeout to write out their queued messages. The number of
+// messages flushed and abandoned by each drain is logged.
+func (manager *DrainManager) Shutdown(timeout time.Duration) {
+	manager.send(&command{action: cmdShutdown, timeout: timeout})
+}
+
+// Done returns a channel that is closed once the manager is shut
+// down.
+func (manager *DrainManager) Done() <-chan bool {
+	return manager.done
+}
+
+func (manager *DrainManager) StopDrain(drainName string, clearStateCache bool) {
+	manager.send(&command{action: cmdStop, name: drainName, clear: clearStateCache})
+}
+
+func (manager *DrainManager) StartDrain(name, uri string, retry retry.Retryer) {
+	manager.send(&command{action: cmdStart, name: name, uri: uri, retryer: retry})
+}
+
+// RestartDrains restarts the named drains (all if none) that are in
+// the given state (eg: FATAL; any if empty), resetting their retry
+// limit. It returns the names of the drains restarted.
+func (manager *DrainManager) RestartDrains(names []string, state string) ([]string, error) {
+	cmd := &command{action: cmdRestart, names: names, state: state}
+	if !manager.send(cmd) {
+		return nil, fmt.Errorf("drain manager is shut down")
+	}
+	return cmd.result, cmd.err
+}
+
+// Reload starts, stops and restarts drains so as to run the given
+// (configured) drains.
+func (manager *DrainManager) Reload(drains map[string]string) {
+	manager.send(&command{action: cmdReload, drains: drains})
+}
+
+// IsRunning returns true if the drain was started on this node.
+func (manager *DrainManager) IsRunning(name string) bool {
+	var running bool
+	manager.send(&command{action: cmdQuery, query: func() {
+		_, running = manager.stmMap[name]
+	}})
+	return running
+}
+
+// hasDrains returns true if the manager was last reloaded with the
+// given drains.
+func (manager *DrainManager) hasDrains(drains map[string]string) bool {
+	var same bool
+	manager.send(&command{action: cmdQuery, query: func() {
+		same = len(mapdiff.MapDiff(manager.drains, drains)) == 0
+	}})
+	return same
+}
+
+func (manager *DrainManager) shutdown(timeout time.Duration) {
+	if timeout > 0 {
+		manager.flushDrains(timeout)
+	}
 	for name, _ := range manager.stmMap {
+		stats := GetDrainStats(name)
 		manager.stopDrain(name, true)
+		// Let another node take over singleton drains right away.
+		if isSingleton(manager.drains[name]) {
+			if err := manager.elector.Resign(name); err != nil {
+				log.Errorf("[drain:%s] Unable to resign leadership -- %v", name, err)
+			}
+		}
+		// stopDrain has cleared the stats from the registry.
+		if timeout > 0 {
+			log.Infof("[drain:%s] Shutdown: flushed %d messages, abandoned %d",
+				name, stats.Get("flushed"), stats.Get("abandoned"))
+		}
 	}
 }
 
-func (manager *DrainManager) StopDrain(drainName string, clearStateCache bool) {
-	manager.mux.Lock()
-	defer manager.mux.Unlock()
-	manager.stopDrain(drainName, clearStateCache)
+// flushDrains asks the running drains to write out their queued
+// messages, and waits up to timeout for them to do so.
+func (manager *DrainManager) flushDrains(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, process := range manager.procMap {
+		if process.Flush() {
+			wg.Add(1)
+			go func(process *DrainProcess) {
+				defer wg.Done()
+				process.Wait()
+			}(process)
+		}
+	}
+	flushed := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		log.Info("All drains flushed")
+	case <-time.After(timeout):
+		log.Infof("Drains did not flush within %v; stopping them", timeout)
+	}
 }
 
-// stopDrain should only be called inside a mutex.
 func (manager *DrainManager) stopDrain(drainName string, clearStateCache bool) {
 	if drainStm, ok := manager.stmMap[drainName]; ok {
 		if err := drainStm.SendAction(state.STOP); err != nil {
@@ -65,22 +294,16 @@ func (manager *DrainManager) stopDrain(drainName string, clearStateCache bool) {
 		}
 		drainStm.Stop()
 		delete(manager.stmMap, drainName)
+		delete(manager.procMap, drainName)
+		delete(manager.startMap, drainName)
 		if clearStateCache {
 			manager.stateCache.Clear(drainName)
+			ClearDrainStats(drainName)
 		}
 	}
-	// Sending on stopCh could block if DrainManager.Run().select
-	// {...} is blocking on a mutex (via Start/Stop). Ideally, get rid
-	// of mutexes and use channels.
-	go func() {
-		manager.stopCh <- true
-	}()
 }
 
-func (manager *DrainManager) StartDrain(name, uri string, retry retry.Retryer) {
-	manager.mux.Lock()
-	defer manager.mux.Unlock()
-
+func (manager *DrainManager) startDrain(name, uri string, retry retry.Retryer) {
 	var stateChangeFn state.StateChangedFn
 
 	_, exists := manager.stmMap[name]
@@ -93,19 +316,148 @@ func (manager *DrainManager) StartDrain(name, uri string, retry retry.Retryer) {
 		}
 	}
 
-	process, err := NewDrainProcess(name, uri)
+	process, err := manager.newProcess(name, uri)
 	if err != nil {
-		log.Error(process.Logf("Couldn't create drain: %v", err))
+		log.Errorf("[drain:%s] Couldn't create drain: %v", name, err)
+		// Not retried (by placeDrains) until its config changes.
+		manager.failed[name] = uri
 		return
 	}
+	delete(manager.failed, name)
 	drainStm := state.NewStateMachine("Drain", process, retry, stateChangeFn)
 	manager.stmMap[name] = drainStm
+	manager.procMap[name] = process
+	manager.startMap[name] = time.Now()
 
 	if err = drainStm.SendAction(state.START); err != nil {
 		log.Fatalf("Failed to start drain %s; %v", name, err)
 	}
 }
 
+func (manager *DrainManager) restartDrains(names []string, state string) ([]string, error) {
+	if len(names) == 0 {
+		for name, _ := range manager.stmMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		if _, ok := manager.stmMap[name]; !ok {
+			return nil, fmt.Errorf("drain %s is not running on this node", name)
+		}
+	}
+	var restarted []string
+	for _, name := range names {
+		drainStm := manager.stmMap[name]
+		if st := drainStm.GetState(); state != "" && st.String() != state {
+			continue
+		}
+		log.Infof("[drain:%s] Restarting drain", name)
+		if err := drainStm.Restart(manager.newRetryer(name)); err != nil {
+			return restarted, err
+		}
+		manager.startMap[name] = time.Now()
+		restarted = append(restarted, name)
+	}
+	return restarted, nil
+}
+
+// reload applies the changes from the currently configured drains to
+// the given ones.
+func (manager *DrainManager) reload(drains map[string]string) {
+	manager.iteration += 1
+	prefix := fmt.Sprintf("CONFIG.%d", manager.iteration)
+	log.Infof(
+		"[%s] checking drains after a config change...",
+		prefix)
+	for _, c := range mapdiff.MapDiff(manager.drains, drains) {
+		delete(manager.failed, c.Key)
+		if c.Deleted {
+			log.Infof("[%s] Drain %s was deleted.", prefix, c.Key)
+			manager.stopDrain(c.Key, true)
+			delete(manager.renewed, c.Key)
+			if isSingleton(manager.drains[c.Key]) {
+				if err := manager.elector.Forget(c.Key); err != nil {
+					log.Errorf("[drain:%s] Unable to clear leadership -- %v", c.Key, err)
+				}
+			}
+			delete(manager.drains, c.Key)
+		} else {
+			log.Infof("[%s] Drain %s was added.", prefix, c.Key)
+			manager.stopDrain(c.Key, false)
+			manager.drains[c.Key] = c.NewValue
+		}
+	}
+	// Also (re)starts the added drains.
+	manager.placeDrains()
+	log.Infof("[%s] Done checking drains.", prefix)
+}
+
+// isSingleton returns true if the drain is placed on `one` node.
+func isSingleton(uri string) bool {
+	placement, err := DrainPlacement(uri)
+	return err == nil && placement.Kind == PLACEMENT_ONE
+}
+
+// placedHere returns true if the drain is to run on this node as per
+// its placement, campaigning for its leadership if placed on `one`
+// node.
+func (manager *DrainManager) placedHere(name, uri string) bool {
+	placement, err := DrainPlacement(uri)
+	if err != nil {
+		log.Errorf("[drain:%s] Invalid placement -- %v", name, err)
+		return false
+	}
+	switch placement.Kind {
+	case PLACEMENT_ROLE:
+		nodeRoles := logyard.GetConfig().NodeRoles[manager.nodeIP]
+		return placement.Matches(manager.nodeIP, nodeRoles)
+	case PLACEMENT_ONE:
+		// The lease runs from (at the earliest) the campaign.
+		now := time.Now()
+		leader, err := manager.elector.Campaign(name)
+		if err != nil {
+			log.Errorf("[drain:%s] Unable to campaign for leadership -- %v", name, err)
+			// Keep running, if so, as long as the lease is sure
+			// to be ours until the next campaign; another node may
+			// be elected once it expires.
+			renewed, ok := manager.renewed[name]
+			if ok && now.Sub(renewed)+PLACEMENT_INTERVAL < LEADER_LEASE {
+				return true
+			}
+			delete(manager.renewed, name)
+			return false
+		}
+		if leader {
+			manager.renewed[name] = now
+		} else {
+			delete(manager.renewed, name)
+		}
+		return leader
+	}
+	return placement.Matches(manager.nodeIP, nil)
+}
+
+// placeDrains starts (or stops) the configured drains that are now
+// placed on (or away from) this node, as a result of the config,
+// leadership or node roles changing.
+func (manager *DrainManager) placeDrains() {
+	for name, uri := range manager.drains {
+		_, running := manager.stmMap[name]
+		if !running && manager.failed[name] == uri {
+			continue
+		}
+		placed := manager.placedHere(name, uri)
+		if placed && !running {
+			log.Infof("[drain:%s] Drain is now placed on this node.", name)
+			manager.startDrain(name, uri, manager.newRetryer(name))
+		} else if !placed && running {
+			log.Infof("[drain:%s] Drain is no longer placed on this node.", name)
+			manager.stopDrain(name, true)
+		}
+	}
+}
+
 // NewRetryerForDrain chooses
 func NewRetryerForDrain(name string) retry.Retryer {
 	var retryLimit time.Duration
@@ -131,46 +483,74 @@ func NewRetryerForDrain(name string) retry.Retryer {
 	return retry.NewProgressiveRetryer(retryLimit)
 }
 
-func (manager *DrainManager) Run() {
-	iteration := 0
-	drains := logyard.GetConfig().Drains
-	log.Infof("Found %d drains to start\n", len(drains))
+// deleteExpiredDrains deletes the drains whose lease expired from
+// the config, which in turn stops them across the cluster.
+func (manager *DrainManager) deleteExpiredDrains() {
+	expired, err := manager.leases.DeleteExpired(time.Now())
+	if err != nil {
+		log.Errorf("Unable to delete expired drains: %v", err)
+		return
+	}
+	for _, name := range expired {
+		log.Infof("[drain:%s] Deleted drain, as its lease expired", name)
+	}
+}
+
+// liveDrains returns the drains whose lease has not expired by now.
+// Expired drains are not run even while they remain in the config
+// (eg: if they could not be deleted yet).
+func (manager *DrainManager) liveDrains(
+	drains map[string]string, meta map[string]logyard.DrainMeta, now time.Time) map[string]string {
+	live := make(map[string]string)
 	for name, uri := range drains {
-		manager.StartDrain(name, uri, NewRetryerForDrain(name))
+		expired, err := manager.leases.Expired(name, meta[name], now)
+		if err != nil {
+			log.Errorf("[drain:%s] Unable to check the lease -- %v", name, err)
+		} else if expired {
+			continue
+		}
+		live[name] = uri
 	}
+	return live
+}
+
+// Run starts the configured drains, and then keeps them in sync with
+// the config until the manager is shut down.
+func (manager *DrainManager) Run() {
+	manager.deleteExpiredDrains()
+	config := logyard.GetConfig()
+	drains := manager.liveDrains(config.Drains, config.DrainMeta, time.Now())
+	log.Infof("Found %d drains to start\n", len(drains))
+	manager.Reload(drains)
+
+	expiryTicker := time.NewTicker(DRAIN_EXPIRY_INTERVAL)
+	defer expiryTicker.Stop()
+	placementTicker := time.NewTicker(PLACEMENT_INTERVAL)
+	defer placementTicker.Stop()
 
 	// Watch for config changes in redis.
 	for {
-		iteration += 1
-		prefix := fmt.Sprintf("CONFIG.%d", iteration)
-
 		select {
 		case err := <-logyard.GetConfigChanges():
 			if err != nil {
 				log.Fatalf("Error re-loading config: %v", err)
 			}
-			log.Infof(
-				"[%s] checking drains after a config change...",
-				prefix)
-			newDrains := logyard.GetConfig().Drains
-			for _, c := range mapdiff.MapDiff(drains, newDrains) {
-				if c.Deleted {
-					log.Infof("[%s] Drain %s was deleted.", prefix, c.Key)
-					manager.StopDrain(c.Key, true)
-					delete(drains, c.Key)
-				} else {
-					log.Infof("[%s] Drain %s was added.", prefix, c.Key)
-					manager.StopDrain(c.Key, false)
-					manager.StartDrain(
-						c.Key,
-						c.NewValue,
-						NewRetryerForDrain(c.Key))
-					drains[c.Key] = c.NewValue
-				}
+			config := logyard.GetConfig()
+			manager.Reload(manager.liveDrains(config.Drains, config.DrainMeta, time.Now()))
+		case <-expiryTicker.C:
+			manager.deleteExpiredDrains()
+			// Stop the drains whose lease expired while running,
+			// even if the config is yet to change.
+			config := logyard.GetConfig()
+			drains := manager.liveDrains(config.Drains, config.DrainMeta, time.Now())
+			if !manager.hasDrains(drains) {
+				manager.Reload(drains)
 			}
-			log.Infof("[%s] Done checking drains.", prefix)
-		case <-manager.stopCh:
-			break
+		case <-placementTicker.C:
+			manager.send(&command{action: cmdPlace})
+		case <-manager.done:
+			log.Info("Drain manager was shut down.")
+			return
 		}
 	}
 }
@@ -0,0 +1,298 @@
+package drain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"logyard"
+	"logyard/util/retry"
+	"logyard/util/state"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// memStateStore is a stateStore kept in memory.
+type memStateStore struct {
+	mux    sync.Mutex
+	states map[string]string
+}
+
+func (s *memStateStore) SetState(name string, st state.State, rev int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.states[name] = st.String()
+}
+
+func (s *memStateStore) Clear(name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.states, name)
+}
+
+// newTestManager returns a running drain manager whose drains are
+// created without the logyard config, and are fed by (never written
+// to) channels rather than the broker.
+func newTestManager() *DrainManager {
+	manager := newDrainManager("127.0.0.1", &memStateStore{
+		states: make(map[string]string)})
+	manager.newProcess = func(name, uri string) (*DrainProcess, error) {
+		cfg, err := ParseDrainUri(name, uri, map[string]string{})
+		if err != nil {
+			return nil, err
+		}
+		cfg.Source = make(chan zmqpubsub.Message)
+		return &DrainProcess{
+			name: name, uri: uri, cfg: cfg, constructor: DRAINS[cfg.Type]}, nil
+	}
+	manager.newRetryer = func(name string) retry.Retryer {
+		return retry.NewProgressiveRetryer(0)
+	}
+	go manager.loop()
+	return manager
+}
+
+// testDrains returns n file drains writing into dir; generation
+// changes their URI, so that reloading restarts them.
+func testDrains(dir string, n, generation int) map[string]string {
+	drains := make(map[string]string)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("test.%d", i)
+		drains[name] = fmt.Sprintf("file://%s?format=%d",
+			filepath.Join(dir, name+".log"), generation)
+	}
+	return drains
+}
+
+func TestManagerConcurrentReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logyard-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager()
+	defer manager.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				manager.Reload(testDrains(dir, 1+(i+j)%5, j))
+				manager.IsRunning("test.0")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	manager.Reload(testDrains(dir, 3, 0))
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("test.%d", i)
+		if running := manager.IsRunning(name); running != (i < 3) {
+			t.Errorf("expected %s running to be %v", name, i < 3)
+		}
+	}
+}
+
+func TestManagerShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logyard-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager()
+	manager.Reload(testDrains(dir, 3, 0))
+
+	// Commands sent during, or after, shutdown must not block.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			manager.Reload(testDrains(dir, 5, i))
+			manager.StopDrain("test.1", true)
+			manager.Shutdown(100 * time.Millisecond)
+		}(i)
+	}
+	finished := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for concurrent shutdowns")
+	}
+
+	select {
+	case <-manager.Done():
+	default:
+		t.Fatal("expected the manager to be done")
+	}
+	if manager.IsRunning("test.0") {
+		t.Fatal("expected no drains to be running after shutdown")
+	}
+	store := manager.stateCache.(*memStateStore)
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	if len(store.states) != 0 {
+		t.Fatalf("expected cached states to be cleared; got %v", store.states)
+	}
+}
+
+// fakeElector is a leaseElector whose campaign outcome is set by
+// tests.
+type fakeElector struct {
+	mux    sync.Mutex
+	leader bool
+	err    error
+}
+
+func (e *fakeElector) set(leader bool, err error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.leader, e.err = leader, err
+}
+
+func (e *fakeElector) Campaign(name string) (bool, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.leader, e.err
+}
+
+func (e *fakeElector) Resign(name string) error { return nil }
+func (e *fakeElector) Forget(name string) error { return nil }
+
+func TestManagerLeaseExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logyard-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager()
+	defer manager.Stop()
+	elector := &fakeElector{leader: true}
+	manager.elector = elector
+
+	manager.Reload(map[string]string{
+		"test.one": "file://" + filepath.Join(dir, "one.log") + "?placement=one"})
+	if !manager.IsRunning("test.one") {
+		t.Fatal("expected the leader to run the drain")
+	}
+
+	// Campaign failures (eg: redis unreachable) are tolerated while
+	// the lease is sure to be ours,
+	elector.set(false, fmt.Errorf("connection refused"))
+	manager.send(&command{action: cmdPlace})
+	if !manager.IsRunning("test.one") {
+		t.Fatal("expected the drain to keep running within the lease")
+	}
+	// but not once it may have expired, and another node elected.
+	manager.send(&command{action: cmdQuery, query: func() {
+		manager.renewed["test.one"] = time.Now().Add(-LEADER_LEASE)
+	}})
+	manager.send(&command{action: cmdPlace})
+	if manager.IsRunning("test.one") {
+		t.Fatal("expected the drain to stop once the lease may have expired")
+	}
+}
+
+func TestManagerRemembersFailedDrains(t *testing.T) {
+	manager := newTestManager()
+	defer manager.Stop()
+	var attempts int
+	newProcess := manager.newProcess
+	manager.newProcess = func(name, uri string) (*DrainProcess, error) {
+		attempts++
+		return newProcess(name, uri)
+	}
+
+	manager.Reload(map[string]string{"test.bad": "bogus://x"})
+	for i := 0; i < 3; i++ {
+		manager.send(&command{action: cmdPlace})
+	}
+	if attempts != 1 {
+		t.Fatalf("expected a single attempt until the config changes; got %d", attempts)
+	}
+	manager.Reload(map[string]string{"test.bad": "bogus://y"})
+	if attempts != 2 {
+		t.Fatalf("expected another attempt after a config change; got %d", attempts)
+	}
+}
+
+// renewedLeases is a leaseStore whose renewals are set by tests.
+type renewedLeases map[string]int64
+
+func (l renewedLeases) Expired(name string, meta logyard.DrainMeta, now time.Time) (bool, error) {
+	if l[name] > meta.Expires {
+		meta.Expires = l[name]
+	}
+	return meta.Expired(now), nil
+}
+
+func (l renewedLeases) DeleteExpired(now time.Time) ([]string, error) {
+	return nil, nil
+}
+
+func TestManagerStopsExpiredDrains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logyard-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager()
+	defer manager.Stop()
+	leases := renewedLeases{}
+	manager.leases = leases
+
+	now := time.Now()
+	drains := testDrains(dir, 2, 0)
+	meta := map[string]logyard.DrainMeta{
+		"test.0": {TTL: "1m", Expires: now.Add(-time.Minute).Unix()},
+		"test.1": {TTL: "1m", Expires: now.Add(-time.Minute).Unix()}}
+	leases["test.1"] = now.Add(time.Minute).Unix()
+	manager.Reload(manager.liveDrains(drains, meta, now))
+	if manager.IsRunning("test.0") || !manager.IsRunning("test.1") {
+		t.Fatal("expected only the renewed drain to run")
+	}
+	// Nothing to reload until the live drains change,
+	if !manager.hasDrains(manager.liveDrains(drains, meta, now)) {
+		t.Fatal("expected the live drains to be unchanged")
+	}
+	// as they do once the renewed lease too expires.
+	live := manager.liveDrains(drains, meta, now.Add(2*time.Minute))
+	if manager.hasDrains(live) {
+		t.Fatal("expected the live drains to change")
+	}
+	manager.Reload(live)
+	if manager.IsRunning("test.1") {
+		t.Fatal("expected the drain to stop once its lease expired")
+	}
+}
+
+func TestManagerKeepsStatsOfModifiedDrains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logyard-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager()
+	defer manager.Stop()
+	ClearDrainStats("test.0")
+
+	manager.Reload(testDrains(dir, 1, 0))
+	GetDrainStats("test.0").Add("written", 1)
+	manager.Reload(testDrains(dir, 1, 1))
+	if !manager.IsRunning("test.0") || GetDrainStats("test.0").Get("written") != 1 {
+		t.Fatal("expected the modified drain to keep its stats")
+	}
+	manager.Reload(map[string]string{})
+	if GetDrainStats("test.0").Get("written") != 0 {
+		t.Fatal("expected the stats of the deleted drain to be cleared")
+	}
+}
@@ -0,0 +1,177 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+const (
+	DEFAULT_MULTILINE_TIMEOUT = time.Second
+	DEFAULT_MULTILINE_MAX     = 500
+)
+
+// MULTILINE_PRESETS maps the names accepted by the `multiline` param
+// to their [start, continuation] regexps.
+var MULTILINE_PRESETS = map[string][2]string{
+	// any indented line continues the previous one.
+	"indented": {"", `^\s`},
+	// stack traces: "\tat ...", "\t... 5 more" and "Caused by: ..."
+	"java": {"", `^\s+(at\s|\.\.\.\s)|^Caused by:`},
+	// tracebacks: indented frames, and the final "SomeError: ..."
+	"python": {"", `^\s|^[\w.]+(Error|Exception|Warning)(:|$)`},
+}
+
+// MultilineAggregator is a stage joining continuation lines (eg: of
+// stack traces) with the line that started them into a single
+// record, per source. A line is a continuation if it matches the
+// continuation regexp, or if it does not match the start regexp. The
+// `text` fields are joined with newlines; the other fields are those
+// of the first line. Drain params:
+//
+//	multiline=java           preset: indented, java or python
+//	multilinestart=REGEXP    lines starting a new record
+//	multilinecont=REGEXP     lines continuing the current record
+//	multilinetimeout=1s      flush a record not continued for this long
+//	multilinemax=500         max lines joined into a record
+//
+// Sources are told apart by message key, app_id, instance_index and
+// source (stdout, stderr, ...).
+type MultilineAggregator struct {
+	start    *regexp.Regexp
+	cont     *regexp.Regexp
+	timeout  time.Duration
+	maxLines int
+	sources  map[string]*multilineRecord
+}
+
+type multilineRecord struct {
+	key     string
+	record  map[string]interface{}
+	lines   []string
+	updated time.Time
+}
+
+// NewMultilineStage creates the aggregator from the drain params.
+func NewMultilineStage(config *DrainConfig) (Stage, error) {
+	start := config.GetParam("multilinestart", "")
+	cont := config.GetParam("multilinecont", "")
+	if preset := config.GetParam("multiline", ""); preset != "" {
+		patterns, ok := MULTILINE_PRESETS[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown multiline preset: %s", preset)
+		}
+		start, cont = patterns[0], patterns[1]
+	}
+	if start == "" && cont == "" {
+		return nil, nil
+	}
+	timeout, err := config.GetParamDuration(
+		"multilinetimeout", DEFAULT_MULTILINE_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multilinetimeout: %s", err)
+	}
+	maxLines, err := config.GetParamInt("multilinemax", DEFAULT_MULTILINE_MAX)
+	if err != nil {
+		return nil, fmt.Errorf("multilinemax is not a number -- %s", err)
+	}
+	return NewMultilineAggregator(start, cont, timeout, maxLines)
+}
+
+// NewMultilineAggregator creates an aggregator from the given start
+// and/or continuation regexps (either may be empty).
+func NewMultilineAggregator(
+	start, cont string, timeout time.Duration, maxLines int) (*MultilineAggregator, error) {
+	m := &MultilineAggregator{
+		timeout:  timeout,
+		maxLines: maxLines,
+		sources:  make(map[string]*multilineRecord),
+	}
+	var err error
+	if start != "" {
+		if m.start, err = regexp.Compile(start); err != nil {
+			return nil, fmt.Errorf("invalid multiline start regexp: %v", err)
+		}
+	}
+	if cont != "" {
+		if m.cont, err = regexp.Compile(cont); err != nil {
+			return nil, fmt.Errorf("invalid multiline continuation regexp: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// NewMultilinePreset creates an aggregator from a preset name, or if
+// there is no such preset, from a continuation regexp.
+func NewMultilinePreset(preset string) (*MultilineAggregator, error) {
+	patterns, ok := MULTILINE_PRESETS[preset]
+	if !ok {
+		patterns = [2]string{"", preset}
+	}
+	return NewMultilineAggregator(
+		patterns[0], patterns[1], DEFAULT_MULTILINE_TIMEOUT, DEFAULT_MULTILINE_MAX)
+}
+
+func (m *MultilineAggregator) Process(msg zmqpubsub.Message, now time.Time) []zmqpubsub.Message {
+	record, err := decodeRecord(msg)
+	if err != nil {
+		return []zmqpubsub.Message{msg}
+	}
+	text, ok := record["text"].(string)
+	if !ok {
+		return []zmqpubsub.Message{msg}
+	}
+	text = strings.TrimRight(text, "\r\n")
+
+	source := m.sourceOf(msg.Key, record)
+	current, exists := m.sources[source]
+
+	if exists && m.isContinuation(text) && len(current.lines) < m.maxLines {
+		current.lines = append(current.lines, text)
+		current.updated = now
+		return nil
+	}
+
+	var msgs []zmqpubsub.Message
+	if exists {
+		msgs = append(msgs, current.message())
+	}
+	m.sources[source] = &multilineRecord{msg.Key, record, []string{text}, now}
+	return msgs
+}
+
+func (m *MultilineAggregator) Tick(now time.Time) []zmqpubsub.Message {
+	var msgs []zmqpubsub.Message
+	for source, current := range m.sources {
+		if now.Sub(current.updated) >= m.timeout {
+			msgs = append(msgs, current.message())
+			delete(m.sources, source)
+		}
+	}
+	return msgs
+}
+
+func (m *MultilineAggregator) isContinuation(text string) bool {
+	if m.cont != nil && m.cont.MatchString(text) {
+		return true
+	}
+	return m.start != nil && !m.start.MatchString(text)
+}
+
+func (m *MultilineAggregator) sourceOf(key string, record map[string]interface{}) string {
+	return strings.Join([]string{
+		key,
+		fieldString(record["app_id"]),
+		fieldString(record["instance_index"]),
+		fieldString(record["source"])}, "\x00")
+}
+
+func (r *multilineRecord) message() zmqpubsub.Message {
+	r.record["text"] = strings.Join(r.lines, "\n")
+	data, _ := json.Marshal(r.record)
+	return zmqpubsub.Message{Key: r.key, Value: string(data)}
+}
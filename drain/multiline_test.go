@@ -0,0 +1,66 @@
+package drain
+
+import (
+	"encoding/json"
+	"github.com/hpcloud/zmqpubsub"
+	"testing"
+	"time"
+)
+
+func TestMultilineJava(t *testing.T) {
+	stage, err := NewMultilineStage(parseTestUri(t, "multiline=java"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	lines := []string{
+		"Exception in thread main java.lang.NullPointerException",
+		"\tat com.example.App.run(App.java:10)",
+		"\tat com.example.App.main(App.java:5)",
+		"Caused by: java.io.IOException",
+		"\t... 2 more",
+		"next message",
+	}
+	var out []zmqpubsub.Message
+	for _, line := range lines {
+		out = append(out, stage.Process(apptailLine("1", line), now)...)
+		// Lines of another instance are aggregated separately.
+		out = append(out, stage.Process(apptailLine("2", "\tat other"), now)...)
+	}
+	expectTexts(t, out,
+		"Exception in thread main java.lang.NullPointerException\n"+
+			"\tat com.example.App.run(App.java:10)\n"+
+			"\tat com.example.App.main(App.java:5)\n"+
+			"Caused by: java.io.IOException\n"+
+			"\t... 2 more")
+
+	// The pending records are flushed after the timeout.
+	if out = stage.Tick(now.Add(500 * time.Millisecond)); len(out) != 0 {
+		t.Fatalf("unexpected flush before the timeout: %v", out)
+	}
+	expectTexts(t, stage.Tick(now.Add(time.Second)),
+		"next message",
+		"\tat other\n\tat other\n\tat other\n\tat other\n\tat other\n\tat other")
+}
+
+func TestMultilineStartRegexp(t *testing.T) {
+	m, err := NewMultilineAggregator(`^\d{4}-`, "", time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	var out []zmqpubsub.Message
+	for _, line := range []string{"2014-01-01 a", "b", "c", "2014-01-01 d"} {
+		out = append(out, m.Process(apptailLine("1", line), now)...)
+	}
+	// multilinemax=2 splits the record.
+	expectTexts(t, out, "2014-01-01 a\nb", "c")
+}
+
+func apptailLine(instance, text string) zmqpubsub.Message {
+	data, _ := json.Marshal(text)
+	return zmqpubsub.Message{
+		Key: "apptail.7",
+		Value: `{"app_id":7, "source":"stderr", "instance_index":` + instance +
+			`, "text":` + string(data) + `}`}
+}
@@ -0,0 +1,406 @@
+package drain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logyard/util/otlp"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/log"
+	"github.com/hpcloud/zmqpubsub"
+	"gopkg.in/tomb.v1"
+)
+
+// Defaults for the otlp drain `batch` and `timeout` params, port and
+// path.
+const (
+	DEFAULT_OTLP_BATCH   = 100
+	DEFAULT_OTLP_TIMEOUT = 10 * time.Second
+	DEFAULT_OTLP_PORT    = "4318"
+	DEFAULT_OTLP_PATH    = "/v1/logs"
+)
+
+// Severities of the syslog levels (0 to 7), as per the OpenTelemetry
+// mapping of syslog.
+var otlpSyslogSeverities = []struct {
+	number int32
+	text   string
+}{
+	{otlp.SEVERITY_FATAL, "EMERGENCY"},
+	{otlp.SEVERITY_ERROR3, "ALERT"},
+	{otlp.SEVERITY_ERROR2, "CRITICAL"},
+	{otlp.SEVERITY_ERROR, "ERROR"},
+	{otlp.SEVERITY_WARN, "WARNING"},
+	{otlp.SEVERITY_INFO2, "NOTICE"},
+	{otlp.SEVERITY_INFO, "INFO"},
+	{otlp.SEVERITY_DEBUG, "DEBUG"},
+}
+
+// Severity numbers of the cloud event severities.
+var otlpEventSeverities = map[string]int32{
+	"ERROR":   otlp.SEVERITY_ERROR,
+	"WARNING": otlp.SEVERITY_WARN,
+	"INFO":    otlp.SEVERITY_INFO,
+}
+
+// OTLPDrain exports messages as OpenTelemetry log records to a
+// collector over OTLP/HTTP (https with otlp+https), eg:
+// otlp+http://collector:4318?encoding=json&batch=500
+type OTLPDrain struct {
+	name   string
+	initCh chan bool
+	*flusher
+	tomb.Tomb
+}
+
+func NewOTLPDrain(name string) DrainType {
+	var d OTLPDrain
+	d.name = name
+	d.initCh = make(chan bool)
+	d.flusher = newFlusher()
+	return &d
+}
+
+// otlpSettings are the OTLPDrain specific params.
+type otlpSettings struct {
+	url         string
+	encoding    string // protobuf or json
+	compression string // gzip or none
+	batchSize   int
+	linger      time.Duration
+	timeout     time.Duration
+}
+
+func parseOTLPSettings(config *DrainConfig) (*otlpSettings, error) {
+	var s otlpSettings
+	var err error
+
+	if config.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	host := config.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, DEFAULT_OTLP_PORT)
+	}
+	path := config.Path
+	if path == "" || path == "/" {
+		path = DEFAULT_OTLP_PATH
+	}
+	s.url = strings.TrimPrefix(config.Scheme, "otlp+") + "://" + host + path
+
+	s.encoding = config.GetParam("encoding", "protobuf")
+	if !(s.encoding == "protobuf" || s.encoding == "json") {
+		return nil, fmt.Errorf("invalid encoding: %s (must be protobuf or json)", s.encoding)
+	}
+
+	s.compression = config.GetParam("compression", "none")
+	if !(s.compression == "none" || s.compression == "gzip") {
+		return nil, fmt.Errorf(
+			"unsupported compression: %s (must be one of: none, gzip)", s.compression)
+	}
+
+	// Up to `batch` messages are exported in a single request,
+	// waiting up to `linger` for the batch to fill up.
+	s.batchSize, err = config.GetParamInt("batch", DEFAULT_OTLP_BATCH)
+	if err != nil || s.batchSize < 1 {
+		return nil, fmt.Errorf("invalid batch size: %s", config.GetParam("batch", ""))
+	}
+	s.linger, err = config.GetParamDuration("linger", 0)
+	if err != nil || s.linger < 0 {
+		return nil, fmt.Errorf("invalid linger: %s", config.GetParam("linger", ""))
+	}
+
+	s.timeout, err = config.GetParamDuration("timeout", DEFAULT_OTLP_TIMEOUT)
+	if err != nil || s.timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout: %s", config.GetParam("timeout", ""))
+	}
+	return &s, nil
+}
+
+func (d *OTLPDrain) Validate(config *DrainConfig) error {
+	_, err := parseOTLPSettings(config)
+	return err
+}
+
+// TestConnection exports an empty request, which collectors accept.
+func (d *OTLPDrain) TestConnection(config *DrainConfig) error {
+	settings, err := parseOTLPSettings(config)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: settings.timeout}
+	return otlpExport(client, settings, &otlp.Request{})
+}
+
+func (d *OTLPDrain) Start(config *DrainConfig) {
+	defer d.Done()
+
+	settings, err := parseOTLPSettings(config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	queue, err := NewMessageQueue(d.name, config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+
+	log.Infof("[drain:%s] Attempting to connect to otlp collector %s ...",
+		d.name, settings.url)
+	client := &http.Client{Timeout: settings.timeout}
+	if err = otlpExport(client, settings, &otlp.Request{}); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	log.Infof("[drain:%s] Successfully connected to otlp collector %s.",
+		d.name, settings.url)
+
+	source, unsubscribe := subscribe(config)
+	defer unsubscribe()
+
+	if err := queue.Start(source); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer queue.Stop()
+
+	go d.finishedStarting(true)
+
+	flushing := d.Flushing()
+	for {
+		select {
+		case <-flushing:
+			flushing = nil
+			queue.Close()
+		case msg, ok := <-queue.Ch:
+			if !ok {
+				// flushed
+				return
+			}
+			batch := []zmqpubsub.Message{msg}
+			var linger <-chan time.Time
+			if settings.linger > 0 {
+				linger = time.After(settings.linger)
+			}
+		collect:
+			for len(batch) < settings.batchSize {
+				if linger == nil {
+					select {
+					case msg, ok := <-queue.Ch:
+						if !ok {
+							break collect
+						}
+						batch = append(batch, msg)
+					default:
+						break collect
+					}
+				} else {
+					select {
+					case msg, ok := <-queue.Ch:
+						if !ok {
+							break collect
+						}
+						batch = append(batch, msg)
+					case <-linger:
+						break collect
+					}
+				}
+			}
+			if err = d.writeBatch(config, settings, client, batch); err != nil {
+				for _, msg := range batch {
+					config.trace(msg, nil, err)
+				}
+				d.Kill(err)
+				return
+			}
+		case <-queue.Dying():
+			d.Kill(queue.Err())
+			return
+		case <-d.Dying():
+			return
+		}
+	}
+}
+
+// writeBatch exports the messages in a single request, with the log
+// records grouped by resource.
+func (d *OTLPDrain) writeBatch(
+	config *DrainConfig, settings *otlpSettings, client *http.Client,
+	batch []zmqpubsub.Message) error {
+	request := &otlp.Request{ScopeName: "logyard"}
+	resources := make(map[string]int) // index in request.ResourceLogs
+	payloads := make([][]byte, len(batch))
+	now := time.Now()
+	for idx, msg := range batch {
+		resource, record, err := otlpLogRecord(config, msg)
+		if err != nil {
+			return err
+		}
+		record.ObservedTime = now
+		payloads[idx] = []byte(record.Body)
+
+		key := fmt.Sprintf("%v", resource)
+		n, ok := resources[key]
+		if !ok {
+			n = len(request.ResourceLogs)
+			resources[key] = n
+			request.ResourceLogs = append(
+				request.ResourceLogs, otlp.ResourceLogs{Resource: resource})
+		}
+		request.ResourceLogs[n].Records = append(request.ResourceLogs[n].Records, record)
+	}
+
+	if err := otlpExport(client, settings, request); err != nil {
+		return err
+	}
+	GetDrainStats(d.name).Add("otlp.exported", int64(len(batch)))
+	for idx, msg := range batch {
+		config.trace(msg, payloads[idx], nil)
+	}
+	return nil
+}
+
+// otlpLogRecord returns the log record for a systail, apptail or
+// event record, along with its resource attributes: node_id becomes
+// host.name, app_name service.name (or, for systail, the process
+// name) and instance_index service.instance.id, while source and the
+// message key become log record attributes. The body is the text (desc
+// for events, or else the whole record) formatted as per the drain's
+// format, if any; and the severity that of the syslog priority (or
+// event severity).
+func otlpLogRecord(
+	config *DrainConfig, msg zmqpubsub.Message) ([]otlp.KeyValue, otlp.LogRecord, error) {
+	var record otlp.LogRecord
+	msg, fields, body, err := config.formatRecord(msg)
+	if err != nil {
+		return nil, record, err
+	}
+
+	if body == "" {
+		body = recordText(fields)
+	}
+	if body == "" {
+		// Not a systail, apptail or event record.
+		body = msg.Value
+	}
+	record.Body = body
+	record.Time = recordTime(fields)
+	record.SeverityNumber, record.SeverityText = otlpSeverity(fields)
+
+	var resource []otlp.KeyValue
+	if nodeID, ok := fields["node_id"].(string); ok && nodeID != "" {
+		resource = append(resource, otlp.KeyValue{Key: "host.name", Value: nodeID})
+	}
+	if appName, ok := fields["app_name"].(string); ok && appName != "" {
+		resource = append(resource, otlp.KeyValue{Key: "service.name", Value: appName})
+	} else if name, ok := fields["name"].(string); ok && name != "" {
+		resource = append(resource, otlp.KeyValue{Key: "service.name", Value: name})
+	}
+	if index, ok := fields["instance_index"].(float64); ok {
+		resource = append(resource, otlp.KeyValue{
+			Key: "service.instance.id", Value: strconv.Itoa(int(index))})
+	}
+
+	if source, ok := fields["source"].(string); ok && source != "" {
+		record.Attributes = append(record.Attributes,
+			otlp.KeyValue{Key: "source", Value: source})
+	}
+	record.Attributes = append(record.Attributes,
+		otlp.KeyValue{Key: "logyard.key", Value: msg.Key})
+	return resource, record, nil
+}
+
+// otlpSeverity returns the severity number and text of the record.
+func otlpSeverity(fields map[string]interface{}) (int32, string) {
+	if syslog, ok := fields["syslog"].(map[string]interface{}); ok {
+		if priority, ok := syslog["priority"].(float64); ok {
+			severity := otlpSyslogSeverities[int(priority)&7]
+			return severity.number, severity.text
+		}
+	}
+	if severity, ok := fields["severity"].(string); ok {
+		if number, ok := otlpEventSeverities[severity]; ok {
+			return number, severity
+		}
+	}
+	return otlp.SEVERITY_UNSPECIFIED, ""
+}
+
+// otlpExport posts the request to the collector, encoded as per the
+// drain's settings.
+func otlpExport(client *http.Client, settings *otlpSettings, request *otlp.Request) error {
+	var data []byte
+	var err error
+	var contentType string
+	if settings.encoding == "json" {
+		data, err = json.Marshal(request)
+		contentType = "application/json"
+	} else {
+		data, err = request.MarshalProtobuf()
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		return err
+	}
+
+	if settings.compression == "gzip" {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	req, err := http.NewRequest("POST", settings.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if settings.compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read (part of) the body, to reuse the connection; or to report
+	// the error.
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector %s -- %s: %s",
+			settings.url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (d *OTLPDrain) finishedStarting(success bool) {
+	d.initCh <- success
+}
+
+func (d *OTLPDrain) WaitRunning() bool {
+	return <-d.initCh
+}
+
+func (d *OTLPDrain) Stop() error {
+	d.Kill(nil)
+	return d.Wait()
+}
@@ -0,0 +1,213 @@
+package drain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// otlpRequest is a request received by the test collector.
+type otlpRequest struct {
+	path        string
+	contentType string
+	body        []byte
+}
+
+func newOTLPCollector(t *testing.T, status int) (*httptest.Server, chan otlpRequest) {
+	requests := make(chan otlpRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err == nil && r.Header.Get("Content-Encoding") == "gzip" {
+				var gz *gzip.Reader
+				if gz, err = gzip.NewReader(bytes.NewReader(body)); err == nil {
+					body, err = ioutil.ReadAll(gz)
+				}
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			requests <- otlpRequest{r.URL.Path, r.Header.Get("Content-Type"), body}
+			w.WriteHeader(status)
+		}))
+	return server, requests
+}
+
+func startOTLPDrain(t *testing.T, uri string) (DrainType, *DrainConfig) {
+	cfg, err := ParseDrainUri("test.otlp", uri, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateDrainConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Source = make(chan zmqpubsub.Message)
+	d := NewOTLPDrain("test.otlp")
+	go d.Start(cfg)
+	if !d.WaitRunning() {
+		t.Fatal(d.Wait())
+	}
+	return d, cfg
+}
+
+func receiveOTLP(t *testing.T, requests chan otlpRequest) otlpRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an otlp request")
+	}
+	panic("unreachable")
+}
+
+func TestOTLPDrainJSON(t *testing.T) {
+	server, requests := newOTLPCollector(t, http.StatusOK)
+	defer server.Close()
+
+	d, cfg := startOTLPDrain(t, strings.Replace(server.URL, "http://", "otlp+http://", 1)+
+		"?encoding=json&compression=gzip&batch=2&linger=1s")
+	defer d.Stop()
+	receiveOTLP(t, requests) // connection test
+
+	for seq := 1; seq <= 2; seq++ {
+		msg, err := SampleMessage("apptail", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Source <- msg
+	}
+	r := receiveOTLP(t, requests)
+	if r.path != "/v1/logs" || r.contentType != "application/json" {
+		t.Fatalf("unexpected request: %s (%s)", r.path, r.contentType)
+	}
+
+	var export struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value struct{ StringValue string }
+				}
+			}
+			ScopeLogs []struct {
+				LogRecords []struct {
+					SeverityNumber int
+					SeverityText   string
+					Body           struct{ StringValue string }
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(r.body, &export); err != nil {
+		t.Fatal(err)
+	}
+	// Both messages are of the same app instance, and so resource.
+	if len(export.ResourceLogs) != 1 {
+		t.Fatalf("unexpected export request: %s", r.body)
+	}
+	resource := make(map[string]string)
+	for _, kv := range export.ResourceLogs[0].Resource.Attributes {
+		resource[kv.Key] = kv.Value.StringValue
+	}
+	if resource["service.name"] != "sample-app" || resource["service.instance.id"] != "0" ||
+		resource["host.name"] == "" {
+		t.Fatalf("unexpected resource attributes: %v", resource)
+	}
+	records := export.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 || records[1].Body.StringValue != "sample apptail message #2" ||
+		records[0].SeverityNumber != 9 || records[0].SeverityText != "INFO" {
+		t.Fatalf("unexpected log records: %s", r.body)
+	}
+}
+
+func TestOTLPDrainProtobuf(t *testing.T) {
+	server, requests := newOTLPCollector(t, http.StatusOK)
+	defer server.Close()
+
+	d, cfg := startOTLPDrain(t,
+		strings.Replace(server.URL, "http://", "otlp+http://", 1)+"/logs")
+	defer d.Stop()
+	receiveOTLP(t, requests)
+
+	msg, err := SampleMessage("systail", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Source <- msg
+	r := receiveOTLP(t, requests)
+	if r.path != "/logs" || r.contentType != "application/x-protobuf" ||
+		!bytes.Contains(r.body, []byte("sample systail message #1")) {
+		t.Fatalf("unexpected request: %s (%s) %q", r.path, r.contentType, r.body)
+	}
+}
+
+func TestOTLPDrainCollectorError(t *testing.T) {
+	server, _ := newOTLPCollector(t, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	cfg, err := ParseDrainUri("test.otlp",
+		strings.Replace(server.URL, "http://", "otlp+http://", 1), map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = TestDrainConnection(cfg); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected a 503 error; got %v", err)
+	}
+}
+
+func TestOTLPLogRecordBody(t *testing.T) {
+	cfg, err := ParseDrainUri("test.otlp", "otlp+http://localhost", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		`{"type":"dea_start","desc":"Started app foo","severity":"ERROR"}`: "Started app foo",
+		`{"text":"hello","desc":"ignored"}`:                                "hello",
+		`{"status":"ok"}`:                                                  `{"status":"ok"}`,
+	}
+	for value, body := range tests {
+		_, record, err := otlpLogRecord(cfg, zmqpubsub.Message{Key: "event.x", Value: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Body != body {
+			t.Fatalf("%s: expected body `%s`; got `%s`", value, body, record.Body)
+		}
+	}
+	_, record, _ := otlpLogRecord(cfg, zmqpubsub.Message{Key: "event.x",
+		Value: `{"desc":"Failed","severity":"ERROR"}`})
+	if record.SeverityNumber != 17 || record.SeverityText != "ERROR" {
+		t.Fatalf("unexpected event severity: %d %s", record.SeverityNumber, record.SeverityText)
+	}
+}
+
+func TestOTLPLogRecordRedactsOnce(t *testing.T) {
+	cfg, err := ParseDrainUri("test.otlpredact",
+		"otlp+http://localhost?format={{.text}}&redact=bearer", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ClearDrainStats(cfg.Name)
+	if cfg.Redactor, err = NewRedactor(cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, record, err := otlpLogRecord(cfg, zmqpubsub.Message{
+		Key: "apptail.1", Value: `{"text":"Bearer abc123"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Body != "Bearer "+REDACTED {
+		t.Fatalf("body not redacted: %s", record.Body)
+	}
+	if n := GetDrainStats(cfg.Name).Get("redactions"); n != 1 {
+		t.Fatalf("expected 1 redaction; got %d", n)
+	}
+}
@@ -0,0 +1,104 @@
+package drain
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Kinds of drain placement, selected by the `placement` param.
+const (
+	PLACEMENT_ALL  = "all"  // run on every node (default)
+	PLACEMENT_NODE = "node" // node=<ip>: run on that node only
+	PLACEMENT_ROLE = "role" // role=<role>: run on nodes with that role
+	PLACEMENT_ONE  = "one"  // run on a single node, elected via redis
+)
+
+// Placement determines which nodes of the cluster run a drain.
+type Placement struct {
+	Kind  string
+	Value string // node ip, or role name
+}
+
+// ParsePlacement parses the `placement` param: all, one, node=<ip>
+// or role=<role>.
+func ParsePlacement(value string) (Placement, error) {
+	if value == "" {
+		return Placement{Kind: PLACEMENT_ALL}, nil
+	}
+	parts := strings.SplitN(value, "=", 2)
+	p := Placement{Kind: parts[0]}
+	switch p.Kind {
+	case PLACEMENT_ALL, PLACEMENT_ONE:
+		if len(parts) == 2 {
+			return p, fmt.Errorf("placement %s takes no value", p.Kind)
+		}
+	case PLACEMENT_NODE, PLACEMENT_ROLE:
+		if len(parts) != 2 || parts[1] == "" {
+			return p, fmt.Errorf("placement %s requires a value (%s=...)", p.Kind, p.Kind)
+		}
+		p.Value = parts[1]
+	default:
+		return p, fmt.Errorf(
+			"unknown placement %s (must be one of: all, one, node=<ip>, role=<role>)",
+			value)
+	}
+	return p, nil
+}
+
+// DrainPlacement returns the placement of the drain with the given
+// URI.
+func DrainPlacement(uri string) (Placement, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Placement{}, err
+	}
+	query := u.Query()
+	return placementParams(query.Get("placement"), query.Get("singleton"))
+}
+
+// placementParams returns the placement given by the `placement` and
+// `singleton` params; singleton=true being short for placement=one.
+func placementParams(placement, singleton string) (Placement, error) {
+	if singleton == "" {
+		return ParsePlacement(placement)
+	}
+	isSingleton, err := strconv.ParseBool(singleton)
+	if err != nil {
+		return Placement{}, fmt.Errorf("singleton is not a boolean -- %s", err)
+	}
+	if !isSingleton {
+		return ParsePlacement(placement)
+	}
+	if placement != "" && placement != PLACEMENT_ONE {
+		return Placement{}, fmt.Errorf(
+			"singleton drains cannot be placed on %s", placement)
+	}
+	return Placement{Kind: PLACEMENT_ONE}, nil
+}
+
+// Matches returns true if the drain may run on the node with the
+// given ip and roles. Drains placed on `one` node match every node;
+// which one actually runs it is decided by election.
+func (p Placement) Matches(nodeIP string, roles []string) bool {
+	switch p.Kind {
+	case PLACEMENT_NODE:
+		return p.Value == nodeIP
+	case PLACEMENT_ROLE:
+		for _, role := range roles {
+			if role == p.Value {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (p Placement) String() string {
+	if p.Value != "" {
+		return p.Kind + "=" + p.Value
+	}
+	return p.Kind
+}
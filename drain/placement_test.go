@@ -0,0 +1,44 @@
+package drain
+
+import (
+	"testing"
+)
+
+func TestPlacement(t *testing.T) {
+	roles := []string{"controller", "router"}
+	tests := []struct {
+		uri     string
+		matches bool
+	}{
+		{"udp://host:1/", true},
+		{"udp://host:1/?placement=all", true},
+		{"udp://host:1/?placement=one", true},
+		{"udp://host:1/?placement=node%3D10.0.0.1", true},
+		{"udp://host:1/?placement=node%3D10.0.0.2", false},
+		{"udp://host:1/?placement=role%3Drouter", true},
+		{"udp://host:1/?placement=role%3Ddea", false},
+		{"udp://host:1/?singleton=true", true},
+	}
+	for _, test := range tests {
+		p, err := DrainPlacement(test.uri)
+		if err != nil {
+			t.Fatalf("%s: %v", test.uri, err)
+		}
+		if p.Matches("10.0.0.1", roles) != test.matches {
+			t.Errorf("%s: expected match=%v", test.uri, test.matches)
+		}
+	}
+
+	if p, _ := DrainPlacement("udp://host:1/?singleton=true"); p.Kind != PLACEMENT_ONE {
+		t.Fatalf("expected singleton drains to be placed on one node; got %s", p)
+	}
+	if _, err := DrainPlacement("udp://host:1/?singleton=1&placement=all"); err == nil {
+		t.Fatal("expected an error for a singleton drain placed on all nodes")
+	}
+
+	for _, invalid := range []string{"some", "node", "role=", "one=1"} {
+		if _, err := ParsePlacement(invalid); err == nil {
+			t.Errorf("expected an error for placement %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package drain
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/log"
+	"github.com/hpcloud/zmqpubsub"
+	"gopkg.in/tomb.v1"
+)
+
+// Overflow policies of MessageQueue, selected by the `overflow`
+// drain param.
+const (
+	OVERFLOW_BLOCK       = "block"         // stop reading from the subscription
+	OVERFLOW_DROP_OLDEST = "drop-oldest"   // discard the oldest queued message
+	OVERFLOW_DROP_NEWEST = "drop-newest"   // discard the incoming message
+	OVERFLOW_SPILL       = "spill-to-disk" // append to a spill file on disk
+)
+
+// SpillDir is where spill-to-disk queues keep their files, unless
+// overridden by the `spilldir` drain param.
+var SpillDir = "/var/stackato/data/logyard/spill"
+
+const (
+	DEFAULT_QUEUE_SIZE  = 1000
+	queueReportInterval = time.Minute
+)
+
+// MessageQueue is a bounded queue sitting between the drain's
+// subscription and its writer, so that a slow writer does not
+// silently back up the ZeroMQ subscription buffer. What happens when
+// the queue is full is decided by its overflow policy.
+type MessageQueue struct {
+	Ch     chan zmqpubsub.Message // messages to be written by the drain
+	name   string
+	size   int
+	policy string
+	buf    []zmqpubsub.Message
+	spill  *spillFile
+	stages []Stage
+	stats  *DrainStats
+
+	closing   chan bool
+	closeOnce sync.Once
+	tomb.Tomb
+}
+
+// NewMessageQueue creates a queue for the drain from its `queue`,
+// `overflow` and `spilldir` params, passing incoming messages through
+// the stages enabled for the drain. The queue does nothing until
+// Start is called.
+func NewMessageQueue(name string, config *DrainConfig) (*MessageQueue, error) {
+	size, err := config.GetParamInt("queue", DEFAULT_QUEUE_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("queue size is not a number -- %s", err)
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("queue size must be positive (got %d)", size)
+	}
+
+	q := &MessageQueue{
+		Ch:      make(chan zmqpubsub.Message),
+		name:    name,
+		size:    size,
+		policy:  config.GetParam("overflow", OVERFLOW_BLOCK),
+		stats:   GetDrainStats(name),
+		closing: make(chan bool),
+	}
+
+	switch q.policy {
+	case OVERFLOW_BLOCK, OVERFLOW_DROP_OLDEST, OVERFLOW_DROP_NEWEST:
+	case OVERFLOW_SPILL:
+		dir := config.GetParam("spilldir", SpillDir)
+		q.spill = &spillFile{path: filepath.Join(dir, name+".spill")}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy: %s", q.policy)
+	}
+
+	if q.stages, err = NewStages(config); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Start starts queueing messages from the given channel, returning
+// immediately.
+func (q *MessageQueue) Start(in chan zmqpubsub.Message) error {
+	if q.spill != nil {
+		if err := q.spill.open(); err != nil {
+			return err
+		}
+	}
+	go q.run(in)
+	return nil
+}
+
+// Stop stops the queue, discarding (and reporting) any messages
+// still in memory or on disk.
+func (q *MessageQueue) Stop() error {
+	q.Kill(nil)
+	return q.Wait()
+}
+
+// Close makes the queue stop reading from its input channel, after
+// taking in the messages already received there and those held back
+// by the stages. Ch is closed once every queued message was read
+// from it; messages read after Close are counted as flushed.
+func (q *MessageQueue) Close() {
+	q.closeOnce.Do(func() { close(q.closing) })
+}
+
+// Len returns the number of messages currently queued, including
+// those spilled to disk.
+func (q *MessageQueue) Len() int {
+	return int(q.stats.Get("queue.length"))
+}
+
+func (q *MessageQueue) run(in chan zmqpubsub.Message) {
+	defer q.Done()
+	defer q.cleanup()
+
+	ticker := time.NewTicker(queueReportInterval)
+	defer ticker.Stop()
+	lastReport := ""
+
+	var stageTick <-chan time.Time
+	if len(q.stages) > 0 {
+		stageTicker := time.NewTicker(STAGE_TICK)
+		defer stageTicker.Stop()
+		stageTick = stageTicker.C
+	}
+
+	closing := q.closing
+	flushing := false
+
+	for {
+		if len(q.buf) == 0 && q.spill != nil && q.spill.pending() > 0 {
+			if err := q.refill(); err != nil {
+				q.Kill(err)
+				return
+			}
+		}
+		if flushing && len(q.buf) == 0 {
+			close(q.Ch)
+			return
+		}
+
+		var out chan zmqpubsub.Message
+		var next zmqpubsub.Message
+		if len(q.buf) > 0 {
+			out = q.Ch
+			next = q.buf[0]
+		}
+
+		input := in
+		if flushing {
+			input = nil
+		} else if q.policy == OVERFLOW_BLOCK && len(q.buf) >= q.size {
+			// Backpressure: leave the message in the subscription
+			// until the writer catches up.
+			input = nil
+		}
+
+		select {
+		case msg := <-input:
+			msgs := RunStages(q.stages, []zmqpubsub.Message{msg}, time.Now())
+			if err := q.pushAll(msgs); err != nil {
+				q.Kill(err)
+				return
+			}
+		case now := <-stageTick:
+			if err := q.pushAll(TickStages(q.stages, now)); err != nil {
+				q.Kill(err)
+				return
+			}
+		case out <- next:
+			q.buf = q.buf[1:]
+			if flushing {
+				q.stats.Add("flushed", 1)
+			}
+		case <-closing:
+			closing, stageTick, flushing = nil, nil, true
+			now := time.Now()
+			msgs := RunStages(q.stages, pendingMessages(in), now)
+			msgs = append(msgs, FlushStages(q.stages, now)...)
+			if err := q.pushAll(msgs); err != nil {
+				q.Kill(err)
+				return
+			}
+		case <-ticker.C:
+			if report := q.stats.String(); report != lastReport {
+				log.Infof("[drain:%s] Queue counters: %s", q.name, report)
+				lastReport = report
+			}
+		case <-q.Dying():
+			return
+		}
+		q.stats.Add("queue.length", q.length()-q.stats.Get("queue.length"))
+	}
+}
+
+// pendingMessages returns the messages that can be received from ch
+// without blocking.
+func pendingMessages(ch chan zmqpubsub.Message) []zmqpubsub.Message {
+	var msgs []zmqpubsub.Message
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func (q *MessageQueue) length() int64 {
+	n := int64(len(q.buf))
+	if q.spill != nil {
+		n += q.spill.pending()
+	}
+	return n
+}
+
+func (q *MessageQueue) pushAll(msgs []zmqpubsub.Message) error {
+	for _, msg := range msgs {
+		if err := q.push(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push queues the incoming message, applying the overflow policy if
+// the queue is full.
+func (q *MessageQueue) push(msg zmqpubsub.Message) error {
+	spilling := q.spill != nil && q.spill.pending() > 0
+	if len(q.buf) < q.size && !spilling {
+		q.buf = append(q.buf, msg)
+		return nil
+	}
+
+	switch q.policy {
+	case OVERFLOW_DROP_NEWEST:
+		q.stats.Add("dropped.newest", 1)
+	case OVERFLOW_DROP_OLDEST:
+		q.buf = append(q.buf[1:], msg)
+		q.stats.Add("dropped.oldest", 1)
+	case OVERFLOW_SPILL:
+		if err := q.spill.write(msg); err != nil {
+			return err
+		}
+		q.stats.Add("spilled", 1)
+	default:
+		// OVERFLOW_BLOCK never reads more than it can hold.
+		q.buf = append(q.buf, msg)
+	}
+	return nil
+}
+
+// refill reads spilled messages back into memory.
+func (q *MessageQueue) refill() error {
+	for len(q.buf) < q.size && q.spill.pending() > 0 {
+		msg, err := q.spill.read()
+		if err != nil {
+			return err
+		}
+		q.buf = append(q.buf, msg)
+	}
+	return nil
+}
+
+func (q *MessageQueue) cleanup() {
+	if abandoned := q.length(); abandoned > 0 {
+		q.stats.Add("abandoned", abandoned)
+		log.Infof("[drain:%s] Abandoning %d queued messages", q.name, abandoned)
+	}
+	q.buf = nil
+	if q.spill != nil {
+		q.spill.remove()
+	}
+	q.stats.Add("queue.length", -q.stats.Get("queue.length"))
+}
+
+// spillFile is an append-only file of "<key> <value>" lines, read
+// back from the start as the queue drains.
+type spillFile struct {
+	path     string
+	w        *os.File
+	r        *bufio.Reader
+	rf       *os.File
+	nwritten int64
+	nread    int64
+}
+
+func (f *spillFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	w, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	rf, err := os.Open(f.path)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	f.w, f.rf, f.r = w, rf, bufio.NewReader(rf)
+	f.nwritten, f.nread = 0, 0
+	return nil
+}
+
+func (f *spillFile) pending() int64 {
+	return f.nwritten - f.nread
+}
+
+func (f *spillFile) write(msg zmqpubsub.Message) error {
+	if _, err := fmt.Fprintf(f.w, "%s %s\n", msg.Key, msg.Value); err != nil {
+		return err
+	}
+	f.nwritten++
+	return nil
+}
+
+func (f *spillFile) read() (zmqpubsub.Message, error) {
+	line, err := f.r.ReadString('\n')
+	if err != nil {
+		return zmqpubsub.Message{}, fmt.Errorf("corrupt spill file %s: %v", f.path, err)
+	}
+	f.nread++
+	parts := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+	if len(parts) != 2 {
+		return zmqpubsub.Message{}, fmt.Errorf("corrupt spill file %s: %q", f.path, line)
+	}
+	if f.pending() == 0 {
+		// Everything was read back; start afresh to keep the file
+		// from growing forever.
+		f.close()
+		if err := f.open(); err != nil {
+			return zmqpubsub.Message{}, err
+		}
+	}
+	return zmqpubsub.Message{Key: parts[0], Value: parts[1]}, nil
+}
+
+func (f *spillFile) close() {
+	if f.w != nil {
+		f.w.Close()
+		f.rf.Close()
+		f.w, f.rf, f.r = nil, nil, nil
+	}
+}
+
+func (f *spillFile) remove() {
+	f.close()
+	f.nwritten, f.nread = 0, 0
+	os.Remove(f.path)
+}
@@ -0,0 +1,141 @@
+package drain
+
+import (
+	"fmt"
+	"github.com/hpcloud/zmqpubsub"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueueDropNewest(t *testing.T) {
+	q := startQueue(t, "test.dropnewest", "queue=2&overflow=drop-newest")
+	defer q.Stop()
+	sendMessages(q, 5)
+	expectMessages(t, q, 0, 1)
+	if n := GetDrainStats("test.dropnewest").Get("dropped.newest"); n != 3 {
+		t.Fatalf("expected 3 dropped messages; got %d", n)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	q := startQueue(t, "test.dropoldest", "queue=2&overflow=drop-oldest")
+	defer q.Stop()
+	sendMessages(q, 5)
+	expectMessages(t, q, 3, 4)
+	if n := GetDrainStats("test.dropoldest").Get("dropped.oldest"); n != 3 {
+		t.Fatalf("expected 3 dropped messages; got %d", n)
+	}
+}
+
+func TestQueueSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logyard-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := startQueue(t, "test.spill", "queue=2&overflow=spill-to-disk&spilldir="+dir)
+	defer q.Stop()
+	sendMessages(q, 5)
+	expectMessages(t, q, 0, 1, 2, 3, 4)
+	if n := GetDrainStats("test.spill").Get("spilled"); n != 3 {
+		t.Fatalf("expected 3 spilled messages; got %d", n)
+	}
+}
+
+func TestQueueInvalidPolicy(t *testing.T) {
+	cfg, err := ParseDrainUri(
+		"test", "tcp://localhost:1/?overflow=sometimes", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMessageQueue("test", cfg); err == nil {
+		t.Fatal("expected an error for unknown overflow policy")
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q := startQueue(t, "test.close", "queue=10&multiline=indented")
+	defer q.Stop()
+	sendMessages(q, 3)
+	// Held back by the multiline stage until flushed.
+	queueInput[q] <- zmqpubsub.Message{
+		Key: "systail.test", Value: `{"text":"line"}`}
+	q.Close()
+	// Let the queue handle Close before reading from it.
+	time.Sleep(20 * time.Millisecond)
+
+	expected := []string{`{"n":0}`, `{"n":1}`, `{"n":2}`, `{"text":"line"}`}
+	for _, value := range expected {
+		select {
+		case msg := <-q.Ch:
+			if msg.Value != value {
+				t.Fatalf("expected %s; got %s", value, msg.Value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", value)
+		}
+	}
+	select {
+	case _, ok := <-q.Ch:
+		if ok {
+			t.Fatal("expected the queue to be closed once flushed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the queue to close")
+	}
+	if n := GetDrainStats("test.close").Get("flushed"); n != 4 {
+		t.Fatalf("expected 4 flushed messages; got %d", n)
+	}
+}
+
+// Test library
+
+var queueInput = make(map[*MessageQueue]chan zmqpubsub.Message)
+
+func startQueue(t *testing.T, name, query string) *MessageQueue {
+	// Stats outlive the queue, and so previous runs of the test.
+	ClearDrainStats(name)
+	cfg, err := ParseDrainUri(
+		name, "tcp://localhost:1/?"+query, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewMessageQueue(name, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan zmqpubsub.Message)
+	if err = q.Start(in); err != nil {
+		t.Fatal(err)
+	}
+	queueInput[q] = in
+	return q
+}
+
+func sendMessages(q *MessageQueue, n int) {
+	for i := 0; i < n; i++ {
+		queueInput[q] <- zmqpubsub.Message{
+			Key: "systail.test", Value: fmt.Sprintf(`{"n":%d}`, i)}
+	}
+}
+
+func expectMessages(t *testing.T, q *MessageQueue, numbers ...int) {
+	for _, n := range numbers {
+		select {
+		case msg := <-q.Ch:
+			if expected := fmt.Sprintf(`{"n":%d}`, n); msg.Value != expected {
+				t.Fatalf("expected %s; got %s", expected, msg.Value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", n)
+		}
+	}
+	select {
+	case msg := <-q.Ch:
+		t.Fatalf("unexpected message %s", msg.Value)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
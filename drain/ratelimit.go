@@ -0,0 +1,257 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/log"
+	"github.com/hpcloud/zmqpubsub"
+)
+
+const DEFAULT_SUPPRESS_REPORT = time.Minute
+
+// RateLimiter is a drain stage limiting the rate of messages with
+// token buckets, configured by the drain params:
+//
+//	ratelimit=200/s       max rate for the drain (per s, m or h)
+//	burst=1000            bucket size for ratelimit (default: the rate)
+//	ratelimitby=app_id    record field to apply per-key limits by
+//	keyratelimit=20/s     max rate for each value of ratelimitby
+//	keyburst=100          bucket size for keyratelimit
+//	sample=0.1            pass on only this fraction of messages
+//	suppressreport=1m     how often to report suppressed messages
+//
+// Suppressed messages are reported by passing on a copy of the last
+// suppressed record (per key) with its text replaced by a summary.
+type RateLimiter struct {
+	name           string
+	rate           float64 // per second; 0 if not limited
+	burst          float64
+	keyField       string
+	keyRate        float64
+	keyBurst       float64
+	sample         float64
+	reportInterval time.Duration
+	lastReport     time.Time
+	bucket         *tokenBucket
+	keyBuckets     map[string]*tokenBucket
+	rand           *rand.Rand
+	stats          *DrainStats
+}
+
+func NewRateLimiter(config *DrainConfig) (Stage, error) {
+	r := &RateLimiter{
+		name:       config.Name,
+		keyField:   config.GetParam("ratelimitby", ""),
+		keyBuckets: make(map[string]*tokenBucket),
+		stats:      GetDrainStats(config.Name),
+	}
+	var err error
+
+	if r.rate, err = parseRate(config.GetParam("ratelimit", "")); err != nil {
+		return nil, err
+	}
+	if r.keyRate, err = parseRate(config.GetParam("keyratelimit", "")); err != nil {
+		return nil, err
+	}
+	if r.keyField != "" && r.keyRate == 0 {
+		return nil, fmt.Errorf("ratelimitby requires keyratelimit")
+	}
+	if r.keyField == "" && r.keyRate != 0 {
+		return nil, fmt.Errorf("keyratelimit requires ratelimitby")
+	}
+
+	burst, err := config.GetParamInt("burst", int(r.rate))
+	if err != nil {
+		return nil, fmt.Errorf("burst is not a number -- %s", err)
+	}
+	keyBurst, err := config.GetParamInt("keyburst", int(r.keyRate))
+	if err != nil {
+		return nil, fmt.Errorf("keyburst is not a number -- %s", err)
+	}
+	// A bucket must hold at least one message.
+	r.burst = float64(burst)
+	if r.burst < 1 {
+		r.burst = 1
+	}
+	r.keyBurst = float64(keyBurst)
+	if r.keyBurst < 1 {
+		r.keyBurst = 1
+	}
+
+	if sample := config.GetParam("sample", ""); sample == "" {
+		r.sample = 1
+	} else if r.sample, err = strconv.ParseFloat(sample, 64); err != nil ||
+		r.sample <= 0 || r.sample > 1 {
+		return nil, fmt.Errorf("sample must be a number in (0, 1]: %s", sample)
+	}
+
+	r.reportInterval, err = config.GetParamDuration(
+		"suppressreport", DEFAULT_SUPPRESS_REPORT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid suppressreport: %s", err)
+	}
+
+	if r.rate == 0 && r.keyRate == 0 && r.sample == 1 {
+		return nil, nil
+	}
+	if r.rate > 0 {
+		r.bucket = newTokenBucket(r.rate, r.burst)
+	}
+	r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.lastReport = time.Now()
+	return r, nil
+}
+
+// parseRate parses rates like "200/s", "1000/m" or "200" (per
+// second), returning the rate per second.
+func parseRate(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	unit := time.Second
+	if idx := strings.Index(s, "/"); idx >= 0 {
+		switch s[idx+1:] {
+		case "s":
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		default:
+			return 0, fmt.Errorf("invalid rate unit in %s (must be s, m or h)", s)
+		}
+		s = s[:idx]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+	return n / unit.Seconds(), nil
+}
+
+func (r *RateLimiter) Process(msg zmqpubsub.Message, now time.Time) []zmqpubsub.Message {
+	if r.sample < 1 && r.rand.Float64() >= r.sample {
+		r.stats.Add("sampled.out", 1)
+		return nil
+	}
+
+	var keyBucket *tokenBucket
+	if r.keyField != "" {
+		key := ""
+		if record, err := decodeRecord(msg); err == nil {
+			key = fieldString(LookupField(record, r.keyField))
+		}
+		keyBucket = r.keyBuckets[key]
+		if keyBucket == nil {
+			keyBucket = newTokenBucket(r.keyRate, r.keyBurst)
+			r.keyBuckets[key] = keyBucket
+		}
+		if !keyBucket.take(now) {
+			keyBucket.suppress(msg)
+			r.stats.Add("ratelimited", 1)
+			return nil
+		}
+	}
+
+	if r.bucket != nil && !r.bucket.take(now) {
+		if keyBucket != nil {
+			// The message was not sent after all.
+			keyBucket.tokens++
+		}
+		r.bucket.suppress(msg)
+		r.stats.Add("ratelimited", 1)
+		return nil
+	}
+	return []zmqpubsub.Message{msg}
+}
+
+func (r *RateLimiter) Tick(now time.Time) []zmqpubsub.Message {
+	if now.Sub(r.lastReport) < r.reportInterval {
+		return nil
+	}
+	r.lastReport = now
+
+	var msgs []zmqpubsub.Message
+	if r.bucket != nil && r.bucket.suppressed > 0 {
+		msgs = append(msgs, r.report(r.bucket))
+	}
+	for key, bucket := range r.keyBuckets {
+		if bucket.suppressed > 0 {
+			msgs = append(msgs, r.report(bucket))
+		} else if bucket.full(now) {
+			// Forget idle keys (eg: of stopped apps).
+			delete(r.keyBuckets, key)
+		}
+	}
+	return msgs
+}
+
+// report returns the synthetic record reporting the messages
+// suppressed in the bucket since the last report.
+func (r *RateLimiter) report(bucket *tokenBucket) zmqpubsub.Message {
+	n := bucket.suppressed
+	msg := bucket.lastSuppressed
+	bucket.suppressed = 0
+	bucket.lastSuppressed = zmqpubsub.Message{}
+
+	text := fmt.Sprintf(
+		"[logyard] %d messages suppressed by the rate limit of drain %s",
+		n, r.name)
+	log.Infof("[drain:%s] %s", r.name, text)
+
+	record, err := decodeRecord(msg)
+	if err != nil {
+		record = make(map[string]interface{})
+	}
+	record["text"] = text
+	data, _ := json.Marshal(record)
+	return zmqpubsub.Message{Key: msg.Key, Value: string(data)}
+}
+
+// tokenBucket allows `burst` messages at once, refilling at `rate`
+// messages per second.
+type tokenBucket struct {
+	rate           float64
+	burst          float64
+	tokens         float64
+	last           time.Time
+	suppressed     int64
+	lastSuppressed zmqpubsub.Message
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *tokenBucket) suppress(msg zmqpubsub.Message) {
+	b.suppressed++
+	b.lastSuppressed = msg
+}
@@ -0,0 +1,105 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hpcloud/zmqpubsub"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	r := newTestRateLimiter(t, "test.ratelimit", "ratelimit=10/s&burst=5")
+	now := time.Now()
+
+	if n := countPassed(r, 20, "1", now); n != 5 {
+		t.Fatalf("expected a burst of 5 messages; got %d", n)
+	}
+	// 0.5 seconds later, 5 more messages are allowed.
+	if n := countPassed(r, 20, "1", now.Add(500*time.Millisecond)); n != 5 {
+		t.Fatalf("expected 5 more messages; got %d", n)
+	}
+	if n := GetDrainStats("test.ratelimit").Get("ratelimited"); n != 30 {
+		t.Fatalf("expected 30 suppressed messages; got %d", n)
+	}
+
+	msgs := r.Tick(now.Add(time.Hour))
+	if len(msgs) != 1 {
+		t.Fatalf("expected a single suppression report; got %d", len(msgs))
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(msgs[0].Value), &record); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(record["text"].(string), "30 messages suppressed") {
+		t.Fatalf("unexpected report: %v", record["text"])
+	}
+	if record["app_id"] != "1" {
+		t.Fatal("report does not retain the suppressed record's fields")
+	}
+}
+
+func TestRateLimitPerKey(t *testing.T) {
+	r := newTestRateLimiter(
+		t, "test.keyratelimit", "ratelimitby=app_id&keyratelimit=60/m&keyburst=2")
+	now := time.Now()
+
+	if n := countPassed(r, 10, "1", now); n != 2 {
+		t.Fatalf("expected 2 messages for app 1; got %d", n)
+	}
+	if n := countPassed(r, 10, "2", now); n != 2 {
+		t.Fatalf("expected 2 messages for app 2; got %d", n)
+	}
+	if msgs := r.Tick(now.Add(time.Hour)); len(msgs) != 2 {
+		t.Fatalf("expected a suppression report per app; got %d", len(msgs))
+	}
+}
+
+func TestSampling(t *testing.T) {
+	r := newTestRateLimiter(t, "test.sample", "sample=0.5")
+	n := countPassed(r, 1000, "1", time.Now())
+	if n < 400 || n > 600 {
+		t.Fatalf("expected about half of the messages to be sampled; got %d", n)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	stage, err := NewRateLimiter(parseTestUri(t, "limit=10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage != nil {
+		t.Fatal("expected no rate limiter when not configured")
+	}
+	if _, err = NewRateLimiter(parseTestUri(t, "ratelimit=10/d")); err == nil {
+		t.Fatal("expected an error for an invalid rate unit")
+	}
+}
+
+// Test library
+
+func newTestRateLimiter(t *testing.T, name, query string) *RateLimiter {
+	ClearDrainStats(name)
+	cfg, err := ParseDrainUri(
+		name, "tcp://localhost:1/?"+query, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage, err := NewRateLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stage.(*RateLimiter)
+}
+
+func countPassed(r *RateLimiter, n int, appID string, now time.Time) int {
+	passed := 0
+	for i := 0; i < n; i++ {
+		msg := zmqpubsub.Message{
+			Key:   "apptail." + appID,
+			Value: fmt.Sprintf(`{"app_id":"%s","text":"line %d"}`, appID, i)}
+		passed += len(r.Process(msg, now))
+	}
+	return passed
+}
@@ -0,0 +1,182 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+const REDACTED = "[REDACTED]"
+
+// RedactRule rewrites the parts of a string matching Regexp with
+// Replacement (which may refer to submatches, as in
+// regexp.ReplaceAllString). Matches can be further validated by
+// Check.
+type RedactRule struct {
+	Name        string
+	Regexp      *regexp.Regexp
+	Replacement string
+	Check       func(match string) bool
+}
+
+// REDACT_RULES are the builtin redaction rules, which can be referred
+// to by name from the `redact` config and drain param.
+var REDACT_RULES = map[string]*RedactRule{
+	"creditcard": {
+		"creditcard",
+		regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		REDACTED,
+		luhnValid},
+	"bearer": {
+		"bearer",
+		regexp.MustCompile(`(?i)(\bbearer\s+)[a-z0-9\-._~+/]+=*`),
+		"${1}" + REDACTED,
+		nil},
+	"urlpass": {
+		"urlpass",
+		regexp.MustCompile(`(\b[a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]+:)[^@/\s]+@`),
+		"${1}" + REDACTED + "@",
+		nil},
+	"email": {
+		"email",
+		regexp.MustCompile(`\b[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}\b`),
+		REDACTED,
+		nil},
+}
+
+// Redactor rewrites the string fields of records using a set of
+// rules.
+type Redactor struct {
+	rules []*RedactRule
+	stats *DrainStats
+}
+
+// NewRedactor returns the redactor for the drain, or nil if no rules
+// apply. Rules are referred to by name from the global list
+// (`redact` in logyard config) and the drain's `redact` param (comma
+// separated); the drain param "none" disables the global rules for
+// that drain. customRules maps names of additional rules to their
+// regexp (`redactrules` in logyard config).
+func NewRedactor(
+	config *DrainConfig, global []string, customRules map[string]string) (*Redactor, error) {
+	names := global
+	if param := config.GetParam("redact", ""); param == "none" {
+		names = nil
+	} else if param != "" {
+		names = append(append([]string{}, global...), strings.Split(param, ",")...)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	r := &Redactor{stats: GetDrainStats(config.Name)}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if pattern, ok := customRules[name]; ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redaction rule %s: %v", name, err)
+			}
+			r.rules = append(r.rules, &RedactRule{name, re, REDACTED, nil})
+		} else if rule, ok := REDACT_RULES[name]; ok {
+			r.rules = append(r.rules, rule)
+		} else {
+			return nil, fmt.Errorf("unknown redaction rule: %s", name)
+		}
+	}
+	return r, nil
+}
+
+// Redact returns the message with its record's string fields
+// redacted. The message is returned as is if nothing was redacted.
+func (r *Redactor) Redact(msg zmqpubsub.Message) (zmqpubsub.Message, error) {
+	record, err := decodeRecord(msg)
+	if err != nil {
+		return msg, err
+	}
+	count := r.redactValue(record)
+	if count == 0 {
+		return msg, nil
+	}
+	r.stats.Add("redactions", int64(count))
+	data, err := json.Marshal(record)
+	if err != nil {
+		return msg, err
+	}
+	return zmqpubsub.Message{Key: msg.Key, Value: string(data)}, nil
+}
+
+// redactValue redacts the strings within the given (map or slice)
+// value in place, returning the number of redactions.
+func (r *Redactor) redactValue(value interface{}) int {
+	count := 0
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if s, ok := item.(string); ok {
+				var n int
+				v[k], n = r.RedactString(s)
+				count += n
+			} else {
+				count += r.redactValue(item)
+			}
+		}
+	case []interface{}:
+		for idx, item := range v {
+			if s, ok := item.(string); ok {
+				var n int
+				v[idx], n = r.RedactString(s)
+				count += n
+			} else {
+				count += r.redactValue(item)
+			}
+		}
+	}
+	return count
+}
+
+// RedactString applies all rules to s, returning the redacted string
+// and the number of redactions.
+func (r *Redactor) RedactString(s string) (string, int) {
+	count := 0
+	for _, rule := range r.rules {
+		s = rule.Regexp.ReplaceAllStringFunc(s, func(match string) string {
+			if rule.Check != nil && !rule.Check(match) {
+				return match
+			}
+			count++
+			return rule.Regexp.ReplaceAllString(match, rule.Replacement)
+		})
+	}
+	return s, count
+}
+
+// luhnValid checks the credit card number checksum, ignoring spaces
+// and dashes.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,67 @@
+package drain
+
+import (
+	"github.com/hpcloud/zmqpubsub"
+	"testing"
+)
+
+func TestRedactBuiltinRules(t *testing.T) {
+	cfg := parseTestUri(t, "redact=creditcard,bearer,urlpass,email")
+	r, err := NewRedactor(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"paid with 4111 1111 1111 1111 today":      "paid with [REDACTED] today",
+		"order 1234567890123 shipped":              "order 1234567890123 shipped",
+		"Authorization: Bearer abc.DEF-123_x==":    "Authorization: Bearer [REDACTED]",
+		"connecting to postgres://app:s3cret@db/x": "connecting to postgres://app:[REDACTED]@db/x",
+		"mail sent to jane.doe@example.com":        "mail sent to [REDACTED]",
+		"nothing to see here":                      "nothing to see here",
+	}
+	for input, expected := range tests {
+		if output, _ := r.RedactString(input); output != expected {
+			t.Fatalf("redacting `%s`: expected `%s`; got `%s`",
+				input, expected, output)
+		}
+	}
+}
+
+func TestRedactMessage(t *testing.T) {
+	cfg := parseTestUri(t, "redact=secret")
+	ClearDrainStats(cfg.Name)
+	r, err := NewRedactor(cfg, []string{"email"}, map[string]string{
+		"secret": "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Redactor = r
+
+	data, err := cfg.FormatJSON(zmqpubsub.Message{
+		Key:   "apptail.1",
+		Value: `{"text":"s3cr3t for bob@example.com","nested":{"list":["s3cr3t"]}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"nested":{"list":["[REDACTED]"]},"text":"[REDACTED] for [REDACTED]"}` + "\n"
+	if string(data) != expected {
+		t.Fatalf("expected `%s`; got `%s`", expected, data)
+	}
+	if n := GetDrainStats("test").Get("redactions"); n != 3 {
+		t.Fatalf("expected 3 redactions; got %d", n)
+	}
+}
+
+func TestRedactOptOut(t *testing.T) {
+	cfg := parseTestUri(t, "redact=none")
+	r, err := NewRedactor(cfg, []string{"email"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != nil {
+		t.Fatal("expected no redactor for redact=none")
+	}
+	if _, err = NewRedactor(parseTestUri(t, "redact=bogus"), nil, nil); err == nil {
+		t.Fatal("expected an error for an unknown rule")
+	}
+}
@@ -1,20 +1,35 @@
 package drain
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"logyard"
+	"logyard/util/templatefuncs"
+	"sort"
 	"strings"
+	"text/template"
 
 	"github.com/hpcloud/log"
 	"github.com/hpcloud/stackato-go/server"
+	"github.com/hpcloud/zmqpubsub"
 	"github.com/vmihailenco/redis"
 	"gopkg.in/tomb.v1"
 )
 
+// Redis drain modes, selected by the `mode` param.
+const (
+	REDIS_MODE_LIST    = "list"    // LPUSH + LTRIM to a bounded list
+	REDIS_MODE_STREAM  = "stream"  // XADD with an approximate MAXLEN
+	REDIS_MODE_PUBLISH = "publish" // PUBLISH to a channel
+)
+
+const DEFAULT_REDIS_BATCH = 100
+
 type RedisDrain struct {
 	client *redis.Client
 	name   string
 	initCh chan bool
+	*flusher
 	tomb.Tomb
 }
 
@@ -22,74 +37,372 @@ func NewRedisDrain(name string) DrainType {
 	var d RedisDrain
 	d.name = name
 	d.initCh = make(chan bool)
+	d.flusher = newFlusher()
 	return &d
 }
 
-func (d *RedisDrain) Start(config *DrainConfig) {
-	defer d.Done()
+// redisSettings are the RedisDrain specific params.
+type redisSettings struct {
+	keyer     *redisKeyer
+	ttl       int64 // seconds
+	limit     int64
+	database  int64
+	mode      string
+	batchSize int
+}
+
+func parseRedisSettings(name string, config *DrainConfig) (*redisSettings, error) {
+	var s redisSettings
+	var err error
+
+	// store messages under `key` (redis key), which may be a
+	// template evaluated against the record. if it is empty, store
+	// them under that message's key.
+	if s.keyer, err = newRedisKeyer(name, config.GetParam("key", "")); err != nil {
+		return nil, fmt.Errorf("invalid key template -- %s", err)
+	}
 
-	// store messages under `redisKey` (redis key). if it is empty,
-	// store them under that message's key.
-	redisKey := config.GetParam("key", "")
+	// expire keys not written to for `ttl` (eg: buffers of deleted
+	// apps).
+	ttl, err := config.GetParamDuration("ttl", 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ttl: %s", err)
+	}
+	s.ttl = int64(ttl.Seconds())
 
+	// limit applies to each key individually.
 	limit, err := config.GetParamInt("limit", 1500)
 	if err != nil {
-		d.Killf("limit key from `params` is not a number -- %s", err)
-		go d.finishedStarting(false)
-		return
+		return nil, fmt.Errorf("limit key from `params` is not a number -- %s", err)
 	}
+	s.limit = int64(limit)
 
 	database, err := config.GetParamInt("database", 0)
 	if err != nil {
-		d.Killf("invalid database specified: %s", err)
+		return nil, fmt.Errorf("invalid database specified: %s", err)
+	}
+	s.database = int64(database)
+
+	s.mode = config.GetParam("mode", REDIS_MODE_LIST)
+	if !(s.mode == REDIS_MODE_LIST || s.mode == REDIS_MODE_STREAM ||
+		s.mode == REDIS_MODE_PUBLISH) {
+		return nil, fmt.Errorf("invalid mode: %s", s.mode)
+	}
+
+	// Commands for up to `batch` messages already waiting in the
+	// queue are sent in a single pipeline.
+	s.batchSize, err = config.GetParamInt("batch", DEFAULT_REDIS_BATCH)
+	if err != nil || s.batchSize < 1 {
+		return nil, fmt.Errorf("invalid batch size: %s", config.GetParam("batch", ""))
+	}
+	return &s, nil
+}
+
+func (d *RedisDrain) Validate(config *DrainConfig) error {
+	_, err := parseRedisSettings(d.name, config)
+	return err
+}
+
+func (d *RedisDrain) TestConnection(config *DrainConfig) error {
+	settings, err := parseRedisSettings(d.name, config)
+	if err != nil {
+		return err
+	}
+	if err = d.connect(redisHost(config.Host), settings.database); err != nil {
+		return err
+	}
+	d.disconnect()
+	return nil
+}
+
+// redisHost translates the "stackato-core" host (with an optional
+// port) to the applog redis on core node. HACK (stackato-specific).
+func redisHost(host string) string {
+	coreIP := server.GetClusterConfig().MbusIp
+	if host == "stackato-core" {
+		return coreIP
+	} else if strings.HasPrefix(host, "stackato-core:") {
+		return fmt.Sprintf("%s:%s", coreIP, host[len("stackato-core:"):])
+	}
+	return host
+}
+
+func (d *RedisDrain) Start(config *DrainConfig) {
+	defer d.Done()
+
+	settings, err := parseRedisSettings(d.name, config)
+	if err != nil {
+		d.Kill(err)
 		go d.finishedStarting(false)
 		return
 	}
 
-	// HACK (stackato-specific): "core" translates to the applog redis on core node
-	coreIP := server.GetClusterConfig().MbusIp
-	if config.Host == "stackato-core" {
-		config.Host = coreIP
-	} else if strings.HasPrefix(config.Host, "stackato-core:") {
-		config.Host = fmt.Sprintf("%s:%s",
-			coreIP, config.Host[len("stackato-core:"):])
+	queue, err := NewMessageQueue(d.name, config)
+	if err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
 	}
 
-	if err = d.connect(config.Host, int64(database)); err != nil {
+	if err = d.connect(redisHost(config.Host), settings.database); err != nil {
 		d.Kill(err)
 		go d.finishedStarting(false)
 		return
 	}
 	defer d.disconnect()
 
-	sub := logyard.Broker.Subscribe(config.Filters...)
-	defer sub.Stop()
+	source, unsubscribe := subscribe(config)
+	defer unsubscribe()
+
+	if err := queue.Start(source); err != nil {
+		d.Kill(err)
+		go d.finishedStarting(false)
+		return
+	}
+	defer queue.Stop()
 
 	go d.finishedStarting(true)
 
+	flushing := d.Flushing()
 	for {
 		select {
-		case msg := <-sub.Ch:
-			key := msg.Key
-			if redisKey != "" {
-				key = redisKey
-			}
-			data, err := config.FormatJSON(msg)
-			if err != nil {
-				d.Kill(err)
+		case <-flushing:
+			flushing = nil
+			queue.Close()
+		case msg, ok := <-queue.Ch:
+			if !ok {
+				// flushed
 				return
 			}
-			_, err = d.Lpushcircular(key, string(data), int64(limit))
+			batch := []zmqpubsub.Message{msg}
+		collect:
+			for len(batch) < settings.batchSize {
+				select {
+				case msg, ok := <-queue.Ch:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, msg)
+				default:
+					break collect
+				}
+			}
+			err := d.writeBatch(config, settings, batch)
 			if err != nil {
+				for _, msg := range batch {
+					config.trace(msg, nil, err)
+				}
 				d.Kill(err)
 				return
 			}
+		case <-queue.Dying():
+			d.Kill(queue.Err())
+			return
 		case <-d.Dying():
 			return
 		}
 	}
 }
 
+// writeBatch sends the commands storing the given messages in a
+// single pipeline.
+func (d *RedisDrain) writeBatch(
+	config *DrainConfig, settings *redisSettings, batch []zmqpubsub.Message) error {
+	cmds, err := d.batchCommands(config, settings, batch)
+	if err != nil || len(cmds.args) == 0 {
+		return err
+	}
+
+	pipeline, err := d.client.PipelineClient()
+	if err != nil {
+		return err
+	}
+	defer pipeline.Close()
+	for _, args := range cmds.args {
+		pipeline.Process(redis.NewIfaceReq(args...))
+	}
+
+	reqs, err := pipeline.RunQueued()
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		if err := req.Err(); err != nil {
+			return err
+		}
+	}
+	for idx, msg := range cmds.sent {
+		config.trace(msg, cmds.payloads[idx], nil)
+	}
+	return nil
+}
+
+// redisCommands are the commands storing a batch of messages, along
+// with the messages they store and their payloads (for tracing).
+type redisCommands struct {
+	args     [][]string
+	sent     []zmqpubsub.Message
+	payloads [][]byte
+}
+
+// batchCommands returns the commands storing the given messages,
+// skipping (and tracing) those that cannot be stored.
+func (d *RedisDrain) batchCommands(
+	config *DrainConfig, settings *redisSettings,
+	batch []zmqpubsub.Message) (*redisCommands, error) {
+	cmds := &redisCommands{}
+	var keys []string
+	seen := make(map[string]bool)
+
+	for _, msg := range batch {
+		// keys may be derived from the record, which is redacted
+		// only once.
+		redacted, err := config.redact(msg)
+		if err != nil {
+			return nil, err
+		}
+		key, err := settings.keyer.Key(redacted)
+		if err != nil {
+			// A record not having the fields used in the key
+			// template should not bring down the drain.
+			GetDrainStats(d.name).Add("redis.invalidkey", 1)
+			log.Errorf("[drain:%s] Skipping message (%s) -- %s",
+				d.name, msg.Key, err)
+			config.trace(msg, nil, err)
+			continue
+		}
+		var args []string
+		var payload []byte
+		switch settings.mode {
+		case REDIS_MODE_STREAM:
+			fields, err := streamFields(config, redacted)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) == 0 {
+				// Redis rejects stream entries without any fields.
+				GetDrainStats(d.name).Add("redis.emptyrecord", 1)
+				log.Errorf("[drain:%s] Skipping empty record (%s)", d.name, msg.Key)
+				config.trace(msg, nil, fmt.Errorf("empty record"))
+				continue
+			}
+			args = append([]string{
+				"XADD", key, "MAXLEN", "~", fmt.Sprintf("%d", settings.limit), "*"},
+				fields...)
+			payload = []byte(strings.Join(args, " "))
+		case REDIS_MODE_PUBLISH:
+			if payload, err = config.format(redacted); err != nil {
+				return nil, err
+			}
+			args = []string{"PUBLISH", key, string(payload)}
+		default:
+			if payload, err = config.format(redacted); err != nil {
+				return nil, err
+			}
+			args = []string{"LPUSH", key, string(payload)}
+		}
+		cmds.args = append(cmds.args, args)
+		cmds.sent = append(cmds.sent, msg)
+		cmds.payloads = append(cmds.payloads, payload)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		// Keep the length of the bounded lists under check
+		if settings.mode == REDIS_MODE_LIST {
+			cmds.args = append(cmds.args,
+				[]string{"LTRIM", key, "0", fmt.Sprintf("%d", settings.limit-1)})
+		}
+		if settings.ttl > 0 && settings.mode != REDIS_MODE_PUBLISH {
+			cmds.args = append(cmds.args,
+				[]string{"EXPIRE", key, fmt.Sprintf("%d", settings.ttl)})
+		}
+	}
+	return cmds, nil
+}
+
+// redisKeyer computes the redis key of a message from the `key`
+// param.
+type redisKeyer struct {
+	fixed string
+	tmpl  *template.Template
+}
+
+func newRedisKeyer(name, key string) (*redisKeyer, error) {
+	if !strings.Contains(key, "{{") {
+		return &redisKeyer{fixed: key}, nil
+	}
+	tmpl, err := templatefuncs.New(name + ":key").Option("missingkey=error").Parse(key)
+	if err != nil {
+		return nil, err
+	}
+	return &redisKeyer{tmpl: tmpl}, nil
+}
+
+// Key returns the redis key for the message, which is the message's
+// own key if no `key` param was specified.
+func (k *redisKeyer) Key(msg zmqpubsub.Message) (string, error) {
+	if k.tmpl == nil {
+		if k.fixed == "" {
+			return msg.Key, nil
+		}
+		return k.fixed, nil
+	}
+	record := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(msg.Value), &record); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := k.tmpl.Execute(&buf, record); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// streamFields returns the field/value pairs of the stream entry for
+// the given message. Top-level record fields become entry fields,
+// unless a format is configured in which case the formatted message
+// is stored in the `message` field. The message must already be
+// redacted.
+func streamFields(config *DrainConfig, msg zmqpubsub.Message) ([]string, error) {
+	if config.Format != nil || config.rawFormat || config.Encoder != nil {
+		data, err := config.format(msg)
+		if err != nil {
+			return nil, err
+		}
+		return []string{"message", strings.TrimSuffix(string(data), "\n")}, nil
+	}
+
+	record := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(msg.Value), &record); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(record))
+	for k, _ := range record {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		var value string
+		if s, ok := record[k].(string); ok {
+			value = s
+		} else {
+			data, err := json.Marshal(record[k])
+			if err != nil {
+				return nil, err
+			}
+			value = string(data)
+		}
+		fields = append(fields, k, value)
+	}
+	return fields, nil
+}
+
 func (d *RedisDrain) finishedStarting(success bool) {
 	d.initCh <- success
 }
@@ -122,25 +435,3 @@ func (d *RedisDrain) connect(addr string, database int64) error {
 func (d *RedisDrain) disconnect() {
 	d.client.Close()
 }
-
-// Lpushcircular works like LPUSH, but trims the right most element if length
-// exceeds maxlen. Returns the list length before trim.
-func (d *RedisDrain) Lpushcircular(
-	key string, item string, maxlen int64) (int64, error) {
-	reply := d.client.LPush(key, item)
-	if err := reply.Err(); err != nil {
-		return -1, err
-	}
-
-	n := reply.Val()
-
-	// Keep the length of the bounded list under check
-	if n > maxlen {
-		reply := d.client.LTrim(key, 0, maxlen-1)
-		if err := reply.Err(); err != nil {
-			return -1, err
-		}
-	}
-
-	return n, nil
-}
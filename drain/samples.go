@@ -0,0 +1,83 @@
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// SAMPLE_KINDS are the kinds of messages SampleMessage can generate,
+// named after their key prefix.
+var SAMPLE_KINDS = []string{"systail", "apptail", "event"}
+
+// SampleMessage returns a synthetic message, like those published by
+// systail, apptail or cloud events, of the given kind. seq is
+// included in the text to tell messages apart.
+func SampleMessage(kind string, seq int) (zmqpubsub.Message, error) {
+	now := time.Now()
+	nodeID := localNodeID()
+	syslog := map[string]interface{}{
+		"priority": 14,
+		"time":     now.UTC().Format("2006-01-02T15:04:05.000000Z07:00")}
+
+	var key string
+	var record map[string]interface{}
+
+	switch kind {
+	case "systail":
+		key = "systail.logyard." + nodeID
+		record = map[string]interface{}{
+			"name":       "logyard",
+			"node_id":    nodeID,
+			"text":       fmt.Sprintf("sample systail message #%d", seq),
+			"unix_time":  now.Unix(),
+			"human_time": now.Format(time.RFC3339),
+			"syslog":     syslog}
+	case "apptail":
+		key = "apptail.1"
+		record = map[string]interface{}{
+			"app_id":         1,
+			"app_name":       "sample-app",
+			"instance_index": 0,
+			"source":         "stdout",
+			"node_id":        nodeID,
+			"text":           fmt.Sprintf("sample apptail message #%d", seq),
+			"unix_time":      now.Unix(),
+			"human_time":     now.Format(time.RFC3339),
+			"syslog":         syslog}
+	case "event":
+		key = "event.logyard_test"
+		record = map[string]interface{}{
+			"type":      "logyard_test",
+			"desc":      fmt.Sprintf("sample cloud event #%d", seq),
+			"text":      fmt.Sprintf("sample cloud event #%d", seq),
+			"severity":  "INFO",
+			"process":   "logyard",
+			"node_id":   nodeID,
+			"unix_time": now.Unix(),
+			"syslog":    syslog}
+	default:
+		return zmqpubsub.Message{}, fmt.Errorf(
+			"unknown sample kind %s (must be one of: %s)",
+			kind, strings.Join(SAMPLE_KINDS, ", "))
+	}
+
+	data, err := json.Marshal(record)
+	return zmqpubsub.Message{Key: key, Value: string(data)}, err
+}
+
+// SampleKindFor returns the kind of sample message matching the
+// drain's first filter, defaulting to systail.
+func SampleKindFor(config *DrainConfig) string {
+	for _, kind := range SAMPLE_KINDS {
+		for _, filter := range config.Filters {
+			if strings.HasPrefix(filter, kind) {
+				return kind
+			}
+		}
+	}
+	return "systail"
+}
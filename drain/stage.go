@@ -0,0 +1,84 @@
+package drain
+
+import (
+	"time"
+
+	"github.com/hpcloud/zmqpubsub"
+)
+
+// Stage transforms the stream of messages received by a drain before
+// they are queued for writing, eg: to drop, merge or add messages.
+// Stages are run by the drain's MessageQueue, from a single
+// goroutine.
+type Stage interface {
+	// Process handles an incoming message, returning the messages to
+	// pass on to the next stage.
+	Process(msg zmqpubsub.Message, now time.Time) []zmqpubsub.Message
+	// Tick is called periodically (every STAGE_TICK), returning any
+	// messages the stage decides to emit as time passes.
+	Tick(now time.Time) []zmqpubsub.Message
+}
+
+// StageConstructor returns a new stage configured from the drain
+// params, or nil if the stage is not enabled for the drain.
+type StageConstructor func(*DrainConfig) (Stage, error)
+
+// STAGES is the ordered list of stages a drain's messages go through.
+var STAGES = []StageConstructor{
+	NewMultilineStage,
+	NewDeduper,
+	NewRateLimiter,
+}
+
+const STAGE_TICK = time.Second
+
+// Stages are flushed by ticking them as if this much time had passed,
+// which is longer than any of their windows or timeouts.
+const stageFlushHorizon = 24 * time.Hour
+
+// NewStages returns the stages enabled for the drain.
+func NewStages(config *DrainConfig) ([]Stage, error) {
+	var stages []Stage
+	for _, constructor := range STAGES {
+		stage, err := constructor(config)
+		if err != nil {
+			return nil, err
+		}
+		if stage != nil {
+			stages = append(stages, stage)
+		}
+	}
+	return stages, nil
+}
+
+// RunStages passes the messages through the given stages in order,
+// returning the resulting messages.
+func RunStages(
+	stages []Stage, msgs []zmqpubsub.Message, now time.Time) []zmqpubsub.Message {
+	for _, stage := range stages {
+		var out []zmqpubsub.Message
+		for _, msg := range msgs {
+			out = append(out, stage.Process(msg, now)...)
+		}
+		msgs = out
+	}
+	return msgs
+}
+
+// TickStages ticks all stages, passing the emitted messages through
+// the remaining stages.
+func TickStages(stages []Stage, now time.Time) []zmqpubsub.Message {
+	var msgs []zmqpubsub.Message
+	for idx, stage := range stages {
+		emitted := stage.Tick(now)
+		msgs = append(msgs, RunStages(stages[idx+1:], emitted, now)...)
+	}
+	return msgs
+}
+
+// FlushStages returns the messages held back by the stages (eg: an
+// incomplete multiline record, or a pending suppression report), as
+// when the drain is stopping.
+func FlushStages(stages []Stage, now time.Time) []zmqpubsub.Message {
+	return TickStages(stages, now.Add(stageFlushHorizon))
+}
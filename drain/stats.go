@@ -0,0 +1,83 @@
+package drain
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DrainStats is a set of named counters maintained by a drain and
+// its supporting stages (queue, etc.) over the lifetime of the
+// logyard process.
+type DrainStats struct {
+	mux      sync.Mutex
+	counters map[string]int64
+}
+
+var statsMux sync.Mutex
+var statsMap = make(map[string]*DrainStats)
+
+// GetDrainStats returns the counters for the given drain, creating
+// them if necessary.
+func GetDrainStats(name string) *DrainStats {
+	statsMux.Lock()
+	defer statsMux.Unlock()
+	stats, ok := statsMap[name]
+	if !ok {
+		stats = &DrainStats{counters: make(map[string]int64)}
+		statsMap[name] = stats
+	}
+	return stats
+}
+
+// ClearDrainStats forgets the counters of a deleted drain.
+func ClearDrainStats(name string) {
+	statsMux.Lock()
+	defer statsMux.Unlock()
+	delete(statsMap, name)
+}
+
+// Add increments the named counter by delta.
+func (s *DrainStats) Add(counter string, delta int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.counters[counter] += delta
+}
+
+// Get returns the current value of the named counter.
+func (s *DrainStats) Get(counter string) int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.counters[counter]
+}
+
+// Snapshot returns a copy of all counters.
+func (s *DrainStats) Snapshot() map[string]int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	counters := make(map[string]int64, len(s.counters))
+	for k, v := range s.counters {
+		counters[k] = v
+	}
+	return counters
+}
+
+// String returns the non-zero counters as "name=value" pairs.
+func (s *DrainStats) String() string {
+	counters := s.Snapshot()
+	keys := make([]string, 0, len(counters))
+	for k, v := range counters {
+		if v != 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	str := ""
+	for _, k := range keys {
+		if str != "" {
+			str += " "
+		}
+		str += fmt.Sprintf("%s=%d", k, counters[k])
+	}
+	return str
+}
@@ -0,0 +1,124 @@
+package logyard
+
+import (
+	"fmt"
+	"github.com/vmihailenco/redis"
+	"time"
+)
+
+// Redis key prefix for the renewed leases of drains.
+const DRAIN_LEASE_PREFIX = "logyard:drainlease:"
+
+// DrainLeases stores the renewals of drain leases in redis, as keys
+// that expire along with the lease. The config only records the
+// lease as of when the drain was added; renewing it there would save
+// (and so reload) the config on every node each time.
+type DrainLeases struct {
+	Prefix string // redis key prefix for the leases
+	Client *redis.Client
+}
+
+// Renew extends the lease of the drain by ttl, or by its original TTL
+// if ttl is 0.
+func (l *DrainLeases) Renew(name string, ttl time.Duration) error {
+	config := GetConfig()
+	if _, ok := config.Drains[name]; !ok {
+		return fmt.Errorf("no such drain: %s", name)
+	}
+	m := config.DrainMeta[name]
+	if m.Expires == 0 {
+		return fmt.Errorf("drain %s has no lease", name)
+	}
+	if ttl == 0 {
+		var err error
+		if ttl, err = time.ParseDuration(m.TTL); err != nil {
+			return fmt.Errorf("invalid ttl of drain %s: %s", name, m.TTL)
+		}
+	}
+	expires := time.Now().Add(ttl)
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	return l.Client.SetEx(
+		l.Prefix+name, seconds, fmt.Sprintf("%d", expires.Unix())).Err()
+}
+
+// Expires returns when the lease of the drain (with the given
+// metadata) expires, as unix time, taking its renewals into account.
+// Drains without a lease never expire (0).
+func (l *DrainLeases) Expires(name string, meta DrainMeta) (int64, error) {
+	if meta.Expires == 0 {
+		return 0, nil
+	}
+	req := redis.NewIntReq("TTL", l.Prefix+name)
+	l.Client.Process(req)
+	if err := req.Err(); err != nil {
+		return 0, err
+	}
+	// Negative if not renewed (or the renewal expired).
+	if expires := time.Now().Unix() + req.Val(); req.Val() >= 0 && expires > meta.Expires {
+		return expires, nil
+	}
+	return meta.Expires, nil
+}
+
+// Expired returns true if the drain's lease, including its renewals,
+// expired by now.
+func (l *DrainLeases) Expired(name string, meta DrainMeta, now time.Time) (bool, error) {
+	expires, err := l.Expires(name, meta)
+	if err != nil {
+		return false, err
+	}
+	return DrainMeta{Expires: expires}.Expired(now), nil
+}
+
+// DeleteExpired deletes the drains whose lease expired by now,
+// returning their names.
+func (l *DrainLeases) DeleteExpired(now time.Time) ([]string, error) {
+	once.Do(createLogyardConfig)
+	// Only write the config when there is something to delete, as
+	// every drain manager in the cluster calls this periodically.
+	found := make(map[string]bool)
+	for name, m := range GetConfig().DrainMeta {
+		expired, err := l.Expired(name, m, now)
+		if err != nil {
+			return nil, err
+		}
+		if expired {
+			found[name] = true
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	var expired []string
+	err := config.AtomicSave(func(i interface{}) error {
+		config := i.(*logyardConfig)
+		expired = nil
+		for name, m := range config.DrainMeta {
+			// Renewals only ever extend the lease in the config.
+			if found[name] && m.Expired(now) {
+				expired = append(expired, name)
+				delete(config.Drains, name)
+				delete(config.DrainMeta, name)
+			}
+		}
+		return nil
+	})
+	if err == nil && len(expired) > 0 {
+		keys := make([]string, len(expired))
+		for i, name := range expired {
+			keys[i] = l.Prefix + name
+		}
+		err = l.Client.Del(keys...).Err()
+	}
+	return expired, err
+}
+
+// Meta returns the metadata of the drain, with the expiry time of its
+// lease as renewed.
+func (l *DrainLeases) Meta(name string) (DrainMeta, error) {
+	m := GetDrainMeta(name)
+	var err error
+	m.Expires, err = l.Expires(name, m)
+	return m, err
+}
@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRecordBatch(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	messages := []Message{
+		{nil, []byte("first"), now},
+		{[]byte("key"), []byte("second"), now.Add(time.Second)},
+	}
+	for _, compression := range []int8{COMPRESSION_NONE, COMPRESSION_GZIP} {
+		data, err := EncodeRecordBatch(messages, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeRecordBatches(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != 2 {
+			t.Fatalf("expected 2 messages; got %d", len(decoded))
+		}
+		for idx, msg := range decoded {
+			if !bytes.Equal(msg.Key, messages[idx].Key) ||
+				!bytes.Equal(msg.Value, messages[idx].Value) ||
+				!msg.Time.Equal(messages[idx].Time) {
+				t.Fatalf("message #%d: expected %+v; got %+v",
+					idx, messages[idx], msg)
+			}
+		}
+		if decoded[0].Key != nil {
+			t.Fatal("expected a null key to remain null")
+		}
+
+		data[len(data)-1] ^= 0xff
+		if _, err = DecodeRecordBatches(data); err == nil {
+			t.Fatal("expected a checksum error for a corrupt batch")
+		}
+	}
+}
+
+// Values as computed by the Java client (Utils.murmur2).
+func TestMurmur2(t *testing.T) {
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+	}
+	for key, expected := range tests {
+		if h := murmur2([]byte(key)); h != expected {
+			t.Errorf("murmur2(%q) = %d; expected %d", key, h, expected)
+		}
+	}
+}
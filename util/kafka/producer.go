@@ -0,0 +1,355 @@
+package kafka
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_PORT = 9092
+
+// Acks levels, ie: which replicas must have written the records
+// before a produce request is acknowledged.
+const (
+	ACKS_NONE   = 0  // not acknowledged at all
+	ACKS_LEADER = 1  // the partition leader
+	ACKS_ALL    = -1 // all in-sync replicas
+)
+
+// Config configures a Producer.
+type Config struct {
+	ClientID    string
+	Acks        int16
+	Compression int8
+	// Timeout applies to connecting and to every request, and is
+	// also how long the broker may wait for the replicas to ack.
+	Timeout time.Duration
+}
+
+// Producer produces messages to the partitions of topics. It is not
+// safe for concurrent use.
+type Producer struct {
+	config        Config
+	seeds         []string
+	brokers       map[int32]string           // broker address by node id
+	leaders       map[string]map[int32]int32 // partition leaders by topic
+	conns         map[string]net.Conn        // by broker address
+	correlationID int32
+}
+
+// NewProducer returns a producer bootstrapping from the given brokers
+// (host, or host:port). No connection is made until needed.
+func NewProducer(seeds []string, config Config) *Producer {
+	p := &Producer{
+		config:  config,
+		brokers: make(map[int32]string),
+		leaders: make(map[string]map[int32]int32),
+		conns:   make(map[string]net.Conn)}
+	for _, seed := range seeds {
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			seed = net.JoinHostPort(seed, strconv.Itoa(DEFAULT_PORT))
+		}
+		p.seeds = append(p.seeds, seed)
+	}
+	return p
+}
+
+// Close closes the connections to the brokers.
+func (p *Producer) Close() {
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// Partitions returns the (sorted) partition ids of the topic, looking
+// up its metadata if not already known.
+func (p *Producer) Partitions(topic string) ([]int32, error) {
+	leaders, ok := p.leaders[topic]
+	if !ok {
+		var err error
+		if leaders, err = p.refreshMetadata(topic); err != nil {
+			return nil, err
+		}
+	}
+	partitions := make([]int32, 0, len(leaders))
+	for partition, _ := range leaders {
+		partitions = append(partitions, partition)
+	}
+	sort.Sort(int32s(partitions))
+	return partitions, nil
+}
+
+// Produce writes the messages, by partition, to the topic. Partitions
+// that fail with a retriable error (eg: leadership changed) are
+// retried once, after looking up their leaders again.
+func (p *Producer) Produce(topic string, messages map[int32][]Message) error {
+	failed, err := p.produce(topic, messages)
+	if err == nil {
+		return nil
+	}
+	if kerr, ok := err.(Error); ok && !kerr.Retriable() {
+		return err
+	}
+	p.Close()
+	delete(p.leaders, topic)
+	_, err = p.produce(topic, failed)
+	return err
+}
+
+// produce makes a single attempt at producing the messages, returning
+// the messages that could not be produced along with the last error.
+func (p *Producer) produce(
+	topic string, messages map[int32][]Message) (map[int32][]Message, error) {
+	if _, err := p.Partitions(topic); err != nil {
+		return messages, err
+	}
+	leaders := p.leaders[topic]
+
+	// Partitions to produce to, by leader.
+	byLeader := make(map[int32][]int32)
+	for partition, _ := range messages {
+		leader, ok := leaders[partition]
+		if !ok {
+			return messages, fmt.Errorf("no such partition: %s/%d", topic, partition)
+		}
+		byLeader[leader] = append(byLeader[leader], partition)
+	}
+
+	failed := make(map[int32][]Message)
+	var lastErr error
+	for leader, partitions := range byLeader {
+		err := p.produceTo(leader, topic, partitions, messages)
+		if err != nil {
+			for _, partition := range partitions {
+				failed[partition] = messages[partition]
+			}
+			lastErr = err
+		}
+	}
+	return failed, lastErr
+}
+
+// produceTo sends a produce request for the given partitions to their
+// leader.
+func (p *Producer) produceTo(
+	leader int32, topic string, partitions []int32, messages map[int32][]Message) error {
+	var body Encoder
+	body.Int16(-1) // transactional id
+	body.Int16(p.config.Acks)
+	body.Int32(int32(p.config.Timeout / time.Millisecond))
+	body.Int32(1) // topics
+	body.Str(topic)
+	body.Int32(int32(len(partitions)))
+	for _, partition := range partitions {
+		batch, err := EncodeRecordBatch(messages[partition], p.config.Compression)
+		if err != nil {
+			return err
+		}
+		body.Int32(partition)
+		body.Bytes(batch)
+	}
+
+	addr, ok := p.brokers[leader]
+	if !ok {
+		return ERR_LEADER_NOT_AVAILABLE
+	}
+	d, err := p.request(addr, API_PRODUCE, PRODUCE_VERSION, body.Data(),
+		p.config.Acks != ACKS_NONE)
+	if err != nil || d == nil {
+		return err
+	}
+	var perr error
+	for topics := d.Int32(); topics > 0; topics-- {
+		d.Str()
+		for n := d.Int32(); n > 0; n-- {
+			d.Int32() // partition
+			code := Error(d.Int16())
+			d.Int64() // base offset
+			d.Int64() // log append time
+			if code != ERR_NONE {
+				perr = code
+			}
+		}
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+	return perr
+}
+
+// refreshMetadata looks up the partition leaders of the topic, asking
+// each known broker in turn.
+func (p *Producer) refreshMetadata(topic string) (map[int32]int32, error) {
+	var body Encoder
+	body.Int32(1)
+	body.Str(topic)
+
+	addrs := append([]string{}, p.seeds...)
+	for _, addr := range p.brokers {
+		addrs = append(addrs, addr)
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		d, err := p.request(addr, API_METADATA, METADATA_VERSION, body.Data(), true)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		leaders, err := p.parseMetadata(d, topic)
+		if err != nil {
+			return nil, err
+		}
+		p.leaders[topic] = leaders
+		return leaders, nil
+	}
+	return nil, fmt.Errorf("unable to fetch metadata of topic %s -- %v", topic, lastErr)
+}
+
+func (p *Producer) parseMetadata(d *Decoder, topic string) (map[int32]int32, error) {
+	for n := d.Int32(); n > 0; n-- {
+		id := d.Int32()
+		host := d.Str()
+		port := d.Int32()
+		d.Str() // rack
+		p.brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.Int32() // controller id
+
+	var leaders map[int32]int32
+	var terr error
+	for n := d.Int32(); n > 0; n-- {
+		code := Error(d.Int16())
+		name := d.Str()
+		d.Int8() // is internal
+		partitions := make(map[int32]int32)
+		for m := d.Int32(); m > 0; m-- {
+			d.Int16() // partition error; the leader may still be known
+			partition := d.Int32()
+			partitions[partition] = d.Int32()
+			for r := d.Int32(); r > 0; r-- {
+				d.Int32() // replicas
+			}
+			for r := d.Int32(); r > 0; r-- {
+				d.Int32() // in-sync replicas
+			}
+		}
+		if name == topic {
+			leaders, terr = partitions, nil
+			if code != ERR_NONE {
+				terr = code
+			}
+		}
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	if terr != nil {
+		return nil, fmt.Errorf("topic %s -- %v", topic, terr)
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("topic %s has no partitions", topic)
+	}
+	return leaders, nil
+}
+
+// request sends a request to the broker, returning a decoder of the
+// response body if one is expected.
+func (p *Producer) request(
+	addr string, apiKey, version int16, body []byte, response bool) (*Decoder, error) {
+	conn, err := p.connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.correlationID++
+	header := RequestHeader{apiKey, version, p.correlationID, p.config.ClientID}
+	if p.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.config.Timeout))
+	}
+	if err = WriteRequest(conn, header, body); err == nil && response {
+		var correlationID int32
+		var d *Decoder
+		correlationID, d, err = ReadResponse(conn)
+		if err == nil && correlationID != header.CorrelationID {
+			err = fmt.Errorf("unexpected correlation id %d (expected %d)",
+				correlationID, header.CorrelationID)
+		}
+		if err == nil {
+			return d, nil
+		}
+	}
+	if err != nil {
+		// The connection state is unknown; reconnect next time.
+		conn.Close()
+		delete(p.conns, addr)
+		return nil, fmt.Errorf("kafka broker %s -- %v", addr, err)
+	}
+	return nil, nil
+}
+
+func (p *Producer) connect(addr string) (net.Conn, error) {
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	timeout := p.config.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+// HashPartition returns the index, among n partitions, of the
+// partition for key. It matches the default partitioner of the Java
+// client (murmur2), so that other producers keying the same way write
+// to the same partitions.
+func HashPartition(key []byte, n int) int {
+	return int(murmur2(key)&0x7fffffff) % n
+}
+
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 |
+			uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+type int32s []int32
+
+func (s int32s) Len() int           { return len(s) }
+func (s int32s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int32s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
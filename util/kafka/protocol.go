@@ -0,0 +1,310 @@
+// kafka implements a minimal Kafka producer: just enough of the wire
+// protocol to look up the leaders of a topic's partitions and produce
+// record batches to them, optionally gzip compressed.
+// https://kafka.apache.org/protocol
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// API keys, and the versions used, of the requests we make. These
+// versions are supported by Kafka 0.11 and later.
+const (
+	API_PRODUCE      = 0
+	API_METADATA     = 3
+	PRODUCE_VERSION  = 3
+	METADATA_VERSION = 1
+)
+
+// Largest response we are willing to read.
+const MAX_RESPONSE_SIZE = 64 * 1024 * 1024
+
+// Error is an error code returned by a Kafka broker.
+type Error int16
+
+// Error codes we handle specifically.
+const (
+	ERR_NONE                       Error = 0
+	ERR_UNKNOWN_TOPIC_OR_PARTITION Error = 3
+	ERR_LEADER_NOT_AVAILABLE       Error = 5
+	ERR_NOT_LEADER_FOR_PARTITION   Error = 6
+	ERR_REQUEST_TIMED_OUT          Error = 7
+	ERR_NOT_ENOUGH_REPLICAS        Error = 19
+)
+
+var errorNames = map[Error]string{
+	ERR_UNKNOWN_TOPIC_OR_PARTITION: "unknown topic or partition",
+	ERR_LEADER_NOT_AVAILABLE:       "leader not available",
+	ERR_NOT_LEADER_FOR_PARTITION:   "not leader for partition",
+	ERR_REQUEST_TIMED_OUT:          "request timed out",
+	ERR_NOT_ENOUGH_REPLICAS:        "not enough replicas",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return fmt.Sprintf("kafka error %d (%s)", int16(e), name)
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+// Retriable returns true for errors that may go away once the
+// partition leaders are looked up again.
+func (e Error) Retriable() bool {
+	switch e {
+	case ERR_UNKNOWN_TOPIC_OR_PARTITION, ERR_LEADER_NOT_AVAILABLE,
+		ERR_NOT_LEADER_FOR_PARTITION, ERR_REQUEST_TIMED_OUT,
+		ERR_NOT_ENOUGH_REPLICAS:
+		return true
+	}
+	return false
+}
+
+// Encoder encodes the primitive types of the protocol.
+type Encoder struct {
+	buf bytes.Buffer
+}
+
+// Data returns the encoded data.
+func (e *Encoder) Data() []byte {
+	return e.buf.Bytes()
+}
+
+// Raw appends b as is.
+func (e *Encoder) Raw(b []byte) {
+	e.buf.Write(b)
+}
+
+func (e *Encoder) Int8(v int8) {
+	e.buf.WriteByte(byte(v))
+}
+
+func (e *Encoder) Int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) Int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) Int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) Str(s string) {
+	e.Int16(int16(len(s)))
+	e.buf.WriteString(s)
+}
+
+// Bytes encodes b with an int32 length; nil as a null (-1) length.
+func (e *Encoder) Bytes(b []byte) {
+	if b == nil {
+		e.Int32(-1)
+		return
+	}
+	e.Int32(int32(len(b)))
+	e.buf.Write(b)
+}
+
+// Varint encodes v as a zig-zag varint, as used in records.
+func (e *Encoder) Varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	e.buf.Write(b[:n])
+}
+
+// VarBytes encodes b with a varint length; nil as a null (-1) length.
+func (e *Encoder) VarBytes(b []byte) {
+	if b == nil {
+		e.Varint(-1)
+		return
+	}
+	e.Varint(int64(len(b)))
+	e.buf.Write(b)
+}
+
+// Decoder decodes the primitive types of the protocol. Once the data
+// runs out, zero values are returned and Err reports the error.
+type Decoder struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+// Err returns the first error encountered while decoding.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Remaining returns the number of bytes yet to be decoded.
+func (d *Decoder) Remaining() int {
+	return len(d.data) - d.off
+}
+
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.off+n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *Decoder) Int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *Decoder) Int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *Decoder) Int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *Decoder) Int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// Str decodes a string; a null string is returned as "".
+func (d *Decoder) Str() string {
+	n := d.Int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *Decoder) Bytes() []byte {
+	n := d.Int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *Decoder) Varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data[d.off:])
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+func (d *Decoder) VarBytes() []byte {
+	n := d.Varint()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// RequestHeader is the header of every request.
+type RequestHeader struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      string
+}
+
+// WriteRequest writes the size-delimited request to w.
+func WriteRequest(w io.Writer, header RequestHeader, body []byte) error {
+	var e Encoder
+	e.Int32(0) // size, filled in below
+	e.Int16(header.APIKey)
+	e.Int16(header.APIVersion)
+	e.Int32(header.CorrelationID)
+	e.Str(header.ClientID)
+	e.Raw(body)
+	data := e.Data()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadRequest reads a request from r, returning its header and a
+// decoder of its body.
+func ReadRequest(r io.Reader) (RequestHeader, *Decoder, error) {
+	var header RequestHeader
+	data, err := readSized(r)
+	if err != nil {
+		return header, nil, err
+	}
+	d := NewDecoder(data)
+	header.APIKey = d.Int16()
+	header.APIVersion = d.Int16()
+	header.CorrelationID = d.Int32()
+	header.ClientID = d.Str()
+	return header, d, d.Err()
+}
+
+// WriteResponse writes the size-delimited response to w.
+func WriteResponse(w io.Writer, correlationID int32, body []byte) error {
+	var e Encoder
+	e.Int32(int32(4 + len(body)))
+	e.Int32(correlationID)
+	e.Raw(body)
+	_, err := w.Write(e.Data())
+	return err
+}
+
+// ReadResponse reads a response from r, returning its correlation id
+// and a decoder of its body.
+func ReadResponse(r io.Reader) (int32, *Decoder, error) {
+	data, err := readSized(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	d := NewDecoder(data)
+	correlationID := d.Int32()
+	return correlationID, d, d.Err()
+}
+
+func readSized(r io.Reader) ([]byte, error) {
+	var size int32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > MAX_RESPONSE_SIZE {
+		return nil, fmt.Errorf("invalid message size: %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
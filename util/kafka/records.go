@@ -0,0 +1,179 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"time"
+)
+
+// Compression codecs of record batches.
+const (
+	COMPRESSION_NONE = 0
+	COMPRESSION_GZIP = 1
+)
+
+// Record batch format (magic) version.
+const RECORD_BATCH_MAGIC = 2
+
+// Size of the record batch header up to, and including, the CRC,
+// which covers the rest of the batch.
+const batchHeaderSize = 8 + 4 + 4 + 1 + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Message is a record to produce (or that was produced).
+type Message struct {
+	Key   []byte // may be nil
+	Value []byte
+	Time  time.Time
+}
+
+// EncodeRecordBatch encodes the messages as a single record batch,
+// compressing the records with the given codec.
+func EncodeRecordBatch(messages []Message, compression int8) ([]byte, error) {
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("empty record batch")
+	}
+	first := millis(messages[0].Time)
+	max := first
+
+	var records Encoder
+	for idx, msg := range messages {
+		ts := millis(msg.Time)
+		if ts > max {
+			max = ts
+		}
+		var r Encoder
+		r.Int8(0) // attributes
+		r.Varint(ts - first)
+		r.Varint(int64(idx))
+		r.VarBytes(msg.Key)
+		r.VarBytes(msg.Value)
+		r.Varint(0) // headers
+		records.Varint(int64(len(r.Data())))
+		records.Raw(r.Data())
+	}
+
+	data := records.Data()
+	switch compression {
+	case COMPRESSION_NONE:
+	case COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	default:
+		return nil, fmt.Errorf("unsupported compression codec: %d", compression)
+	}
+
+	var e Encoder
+	e.Int64(0)  // base offset; assigned by the broker
+	e.Int32(0)  // batch length, filled in below
+	e.Int32(-1) // partition leader epoch
+	e.Int8(RECORD_BATCH_MAGIC)
+	e.Int32(0) // crc, filled in below
+	e.Int16(int16(compression))
+	e.Int32(int32(len(messages) - 1)) // last offset delta
+	e.Int64(first)
+	e.Int64(max)
+	e.Int64(-1) // producer id
+	e.Int16(-1) // producer epoch
+	e.Int32(-1) // base sequence
+	e.Int32(int32(len(messages)))
+	e.Raw(data)
+
+	batch := e.Data()
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	binary.BigEndian.PutUint32(batch[batchHeaderSize-4:],
+		crc32.Checksum(batch[batchHeaderSize:], castagnoli))
+	return batch, nil
+}
+
+// DecodeRecordBatches decodes the messages of the record batches in
+// data, verifying their checksum.
+func DecodeRecordBatches(data []byte) ([]Message, error) {
+	var messages []Message
+	d := NewDecoder(data)
+	for d.Remaining() > 0 {
+		d.Int64() // base offset
+		length := d.Int32()
+		if d.Err() == nil && (length < batchHeaderSize-12 || int(length) > d.Remaining()) {
+			return nil, fmt.Errorf("invalid record batch length: %d", length)
+		}
+		start := d.off
+		d.Int32() // partition leader epoch
+		if magic := d.Int8(); magic != RECORD_BATCH_MAGIC {
+			return nil, fmt.Errorf("unsupported record batch magic: %d", magic)
+		}
+		crc := uint32(d.Int32())
+		if d.Err() != nil {
+			return nil, d.Err()
+		}
+		end := start + int(length)
+		if crc32.Checksum(d.data[d.off:end], castagnoli) != crc {
+			return nil, fmt.Errorf("record batch checksum mismatch")
+		}
+		compression := d.Int16() & 0x07
+		d.Int32() // last offset delta
+		first := d.Int64()
+		d.Int64() // max timestamp
+		d.Int64() // producer id
+		d.Int16() // producer epoch
+		d.Int32() // base sequence
+		count := d.Int32()
+		if d.Err() != nil {
+			return nil, d.Err()
+		}
+
+		records := d.data[d.off:end]
+		d.off = end
+		switch compression {
+		case COMPRESSION_NONE:
+		case COMPRESSION_GZIP:
+			r, err := gzip.NewReader(bytes.NewReader(records))
+			if err != nil {
+				return nil, err
+			}
+			if records, err = ioutil.ReadAll(r); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported compression codec: %d", compression)
+		}
+
+		rd := NewDecoder(records)
+		for i := int32(0); i < count; i++ {
+			rd.Varint() // record length
+			rd.Int8()   // attributes
+			ts := first + rd.Varint()
+			rd.Varint() // offset delta
+			msg := Message{Key: rd.VarBytes(), Value: rd.VarBytes()}
+			msg.Time = time.Unix(0, ts*int64(time.Millisecond))
+			for headers := rd.Varint(); headers > 0; headers-- {
+				rd.VarBytes()
+				rd.VarBytes()
+			}
+			if rd.Err() != nil {
+				return nil, rd.Err()
+			}
+			messages = append(messages, msg)
+		}
+	}
+	return messages, d.Err()
+}
+
+func millis(t time.Time) int64 {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
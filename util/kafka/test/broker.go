@@ -0,0 +1,179 @@
+package test
+
+import (
+	"logyard/util/kafka"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Broker is an in-process stand-in for a single node Kafka cluster,
+// answering metadata and produce requests (as made by kafka.Producer)
+// for a single topic.
+type Broker struct {
+	Topic      string
+	Partitions int
+	listener   net.Listener
+	mux        sync.Mutex
+	records    map[int32][]kafka.Message
+	acks       []int16
+	err        kafka.Error // returned for produce requests, if set
+}
+
+// NewBroker starts a broker listening on a random local port.
+func NewBroker(topic string, partitions int) (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		Topic:      topic,
+		Partitions: partitions,
+		listener:   listener,
+		records:    make(map[int32][]kafka.Message)}
+	go b.serve()
+	return b, nil
+}
+
+// Addr returns the host:port the broker listens on.
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *Broker) Close() error {
+	return b.listener.Close()
+}
+
+// SetError makes the broker fail the produce requests it receives
+// with the given error (until set to kafka.ERR_NONE).
+func (b *Broker) SetError(err kafka.Error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.err = err
+}
+
+// Records returns the messages produced to the partition.
+func (b *Broker) Records(partition int32) []kafka.Message {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]kafka.Message{}, b.records[partition]...)
+}
+
+// Count returns the number of messages produced to all partitions.
+func (b *Broker) Count() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	count := 0
+	for _, records := range b.records {
+		count += len(records)
+	}
+	return count
+}
+
+// Acks returns the acks level of the produce requests received.
+func (b *Broker) Acks() []int16 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]int16{}, b.acks...)
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header, d, err := kafka.ReadRequest(conn)
+		if err != nil {
+			return
+		}
+		var body []byte
+		switch header.APIKey {
+		case kafka.API_METADATA:
+			body = b.metadata()
+		case kafka.API_PRODUCE:
+			var acks int16
+			if body, acks, err = b.produce(d); err != nil {
+				return
+			}
+			if acks == kafka.ACKS_NONE {
+				continue
+			}
+		default:
+			return
+		}
+		if kafka.WriteResponse(conn, header.CorrelationID, body) != nil {
+			return
+		}
+	}
+}
+
+func (b *Broker) metadata() []byte {
+	host, port, _ := net.SplitHostPort(b.Addr())
+	portNum, _ := strconv.Atoi(port)
+	var e kafka.Encoder
+	e.Int32(1) // brokers
+	e.Int32(0) // node id
+	e.Str(host)
+	e.Int32(int32(portNum))
+	e.Int16(-1) // rack
+	e.Int32(0)  // controller id
+	e.Int32(1)  // topics
+	e.Int16(0)
+	e.Str(b.Topic)
+	e.Int8(0)
+	e.Int32(int32(b.Partitions))
+	for i := 0; i < b.Partitions; i++ {
+		e.Int16(0)
+		e.Int32(int32(i))
+		e.Int32(0) // leader
+		e.Int32(1) // replicas
+		e.Int32(0)
+		e.Int32(1) // in-sync replicas
+		e.Int32(0)
+	}
+	return e.Data()
+}
+
+func (b *Broker) produce(d *kafka.Decoder) ([]byte, int16, error) {
+	d.Str() // transactional id
+	acks := d.Int16()
+	d.Int32() // timeout
+
+	var e kafka.Encoder
+	topics := d.Int32()
+	e.Int32(topics)
+	for ; topics > 0; topics-- {
+		topic := d.Str()
+		e.Str(topic)
+		partitions := d.Int32()
+		e.Int32(partitions)
+		for ; partitions > 0; partitions-- {
+			partition := d.Int32()
+			messages, err := kafka.DecodeRecordBatches(d.Bytes())
+			if err != nil {
+				return nil, acks, err
+			}
+			b.mux.Lock()
+			code := b.err
+			if code == kafka.ERR_NONE {
+				b.records[partition] = append(b.records[partition], messages...)
+			}
+			b.acks = append(b.acks, acks)
+			b.mux.Unlock()
+			e.Int32(partition)
+			e.Int16(int16(code))
+			e.Int64(0)  // base offset
+			e.Int64(-1) // log append time
+		}
+	}
+	e.Int32(0) // throttle time
+	return e.Data(), acks, d.Err()
+}
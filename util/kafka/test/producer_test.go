@@ -0,0 +1,61 @@
+package test
+
+import (
+	"logyard/util/kafka"
+	"testing"
+	"time"
+)
+
+func TestProduce(t *testing.T) {
+	broker, err := NewBroker("logs", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	p := kafka.NewProducer([]string{broker.Addr()}, kafka.Config{
+		ClientID:    "test",
+		Acks:        kafka.ACKS_ALL,
+		Compression: kafka.COMPRESSION_GZIP,
+		Timeout:     time.Second})
+	defer p.Close()
+
+	partitions, err := p.Partitions("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 3 {
+		t.Fatalf("expected 3 partitions; got %v", partitions)
+	}
+
+	err = p.Produce("logs", map[int32][]kafka.Message{
+		0: {{Value: []byte("a")}, {Value: []byte("b")}},
+		2: {{Key: []byte("k"), Value: []byte("c")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := broker.Records(0); len(records) != 2 || string(records[1].Value) != "b" {
+		t.Fatalf("unexpected records in partition 0: %+v", records)
+	}
+	if records := broker.Records(2); len(records) != 1 || string(records[0].Key) != "k" {
+		t.Fatalf("unexpected records in partition 2: %+v", records)
+	}
+	if acks := broker.Acks(); acks[0] != kafka.ACKS_ALL {
+		t.Fatalf("unexpected acks: %v", acks)
+	}
+
+	broker.SetError(kafka.ERR_NOT_LEADER_FOR_PARTITION)
+	err = p.Produce("logs", map[int32][]kafka.Message{1: {{Value: []byte("d")}}})
+	if err != kafka.ERR_NOT_LEADER_FOR_PARTITION {
+		t.Fatalf("expected the broker error; got %v", err)
+	}
+	// The failed request is retried once.
+	if n := len(broker.Acks()); n != 4 {
+		t.Fatalf("expected 4 produce requests; got %d", n)
+	}
+	broker.SetError(kafka.ERR_NONE)
+
+	if _, err = p.Partitions("missing"); err == nil {
+		t.Fatal("expected an error looking up an unknown topic")
+	}
+}
@@ -0,0 +1,218 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Largest string, bin, array or map we are willing to decode.
+const MAX_DECODE_LENGTH = 64 * 1024 * 1024
+
+// Unmarshal decodes the single MessagePack value in data (see
+// Decode).
+func Unmarshal(data []byte) (interface{}, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	v, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("msgpack: trailing data")
+	}
+	return v, nil
+}
+
+// Decode reads the next MessagePack value from r. Integers are
+// decoded as int64 (or uint64 if too large), floats as float64, str
+// as string, bin as []byte, arrays as []interface{}, maps as
+// map[string]interface{} (other key types are not supported) and
+// extension types as Ext.
+func Decode(r *bufio.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return decodeMap(r, int(b&0x0f))
+	case b&0xf0 == 0x90:
+		return decodeArray(r, int(b&0x0f))
+	case b&0xe0 == 0xa0:
+		return decodeString(r, int(b&0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readLength(r, b-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readBytes(r, n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readLength(r, b-0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return decodeExt(r, n)
+	case 0xca:
+		var f float32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(f), err
+	case 0xcb:
+		var bits uint64
+		err := binary.Read(r, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	case 0xcc:
+		var n uint8
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xcd:
+		var n uint16
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xce:
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xcf:
+		var n uint64
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		var n int8
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xd1:
+		var n int16
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xd2:
+		var n int32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xd3:
+		var n int64
+		err := binary.Read(r, binary.BigEndian, &n)
+		return n, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return decodeExt(r, 1<<(b-0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := readLength(r, b-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return decodeString(r, n)
+	case 0xdc, 0xdd:
+		n, err := readLength(r, b-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return decodeArray(r, n)
+	case 0xde, 0xdf:
+		n, err := readLength(r, b-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMap(r, n)
+	}
+	return nil, fmt.Errorf("msgpack: invalid type byte 0x%x", b)
+}
+
+// readLength reads a length of 1, 2 or 4 bytes (size 0, 1 or 2).
+func readLength(r *bufio.Reader, size byte) (int, error) {
+	var n uint32
+	var err error
+	switch size {
+	case 0:
+		var n8 uint8
+		err = binary.Read(r, binary.BigEndian, &n8)
+		n = uint32(n8)
+	case 1:
+		var n16 uint16
+		err = binary.Read(r, binary.BigEndian, &n16)
+		n = uint32(n16)
+	default:
+		err = binary.Read(r, binary.BigEndian, &n)
+	}
+	if err == nil && n > MAX_DECODE_LENGTH {
+		err = fmt.Errorf("msgpack: length %d too large", n)
+	}
+	return int(n), err
+}
+
+func readBytes(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func decodeString(r *bufio.Reader, n int) (interface{}, error) {
+	b, err := readBytes(r, n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func decodeExt(r *bufio.Reader, n int) (interface{}, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readBytes(r, n)
+	if err != nil {
+		return nil, err
+	}
+	return Ext{int8(typ), data}, nil
+}
+
+func decodeArray(r *bufio.Reader, n int) (interface{}, error) {
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func decodeMap(r *bufio.Reader, n int) (interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: unsupported map key type %T", k)
+		}
+		if m[key], err = Decode(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,250 @@
+// msgpack implements encoding (and decoding) of the value types
+// produced by encoding/json (and a few more) in the MessagePack format.
+// http://msgpack.org/
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Marshal returns the MessagePack encoding of v, which may be nil, a
+// bool, string, []byte, any integer or float type, an Ext, a slice of
+// interface{} or strings, or a map of strings to interface{} or
+// strings. Map keys are encoded in sorted order. Floats having an
+// integral value (as decoded from JSON) are encoded as integers.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode writes the MessagePack encoding of v to buf.
+func Encode(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if val {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		encodeInt(buf, int64(val))
+	case int32:
+		encodeInt(buf, int64(val))
+	case int64:
+		encodeInt(buf, val)
+	case uint:
+		encodeUint(buf, uint64(val))
+	case uint32:
+		encodeUint(buf, uint64(val))
+	case uint64:
+		encodeUint(buf, val)
+	case float32:
+		encodeFloat(buf, float64(val))
+	case float64:
+		encodeFloat(buf, val)
+	case string:
+		encodeString(buf, val)
+	case []byte:
+		encodeBin(buf, val)
+	case Ext:
+		encodeExt(buf, val)
+	case []interface{}:
+		EncodeArrayHeader(buf, len(val))
+		for _, item := range val {
+			if err := Encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case []string:
+		EncodeArrayHeader(buf, len(val))
+		for _, item := range val {
+			encodeString(buf, item)
+		}
+	case map[string]interface{}:
+		EncodeMapHeader(buf, len(val))
+		for _, k := range sortedKeys(val) {
+			encodeString(buf, k)
+			if err := Encode(buf, val[k]); err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		EncodeMapHeader(buf, len(val))
+		keys := make([]string, 0, len(val))
+		for k, _ := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeString(buf, k)
+			encodeString(buf, val[k])
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// EncodeArrayHeader writes the header of an array of n elements,
+// which are to be encoded next.
+func EncodeArrayHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xdc)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdd)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// EncodeMapHeader writes the header of a map of n key/value pairs,
+// which are to be encoded next.
+func EncodeMapHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xde)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdf)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0:
+		encodeUint(buf, uint64(n))
+	case n >= -32:
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 128:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeFloat(buf *bytes.Buffer, f float64) {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f <= math.MaxInt64 {
+		encodeInt(buf, int64(f))
+		return
+	}
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func encodeBin(buf *bytes.Buffer, b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xc4)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(b)
+}
+
+// Ext is a value of an application-defined (extension) type.
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+func encodeExt(buf *bytes.Buffer, ext Ext) {
+	n := len(ext.Data)
+	switch {
+	case n == 1:
+		buf.WriteByte(0xd4)
+	case n == 2:
+		buf.WriteByte(0xd5)
+	case n == 4:
+		buf.WriteByte(0xd6)
+	case n == 8:
+		buf.WriteByte(0xd7)
+	case n == 16:
+		buf.WriteByte(0xd8)
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xc7)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc8)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc9)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteByte(byte(ext.Type))
+	buf.Write(ext.Data)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
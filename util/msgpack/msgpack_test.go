@@ -0,0 +1,93 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{float64(1), "01"},
+		{float64(-1), "ff"},
+		{float64(300), "cd012c"},
+		{1.5, "cb3ff8000000000000"},
+		{"abc", "a3616263"},
+		{[]interface{}{"a", float64(1)}, "92a16101"},
+		{map[string]interface{}{"b": false, "a": nil}, "82a161c0a162c2"},
+		{map[string]string{"k": "v"}, "81a16ba176"},
+	}
+	for _, test := range tests {
+		data, err := Marshal(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(data) != test.expected {
+			t.Fatalf("Marshal(%#v) = %x; expected %s",
+				test.value, data, test.expected)
+		}
+	}
+}
+
+func TestLongString(t *testing.T) {
+	s := string(bytes.Repeat([]byte("x"), 40))
+	data, err := Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0xd9 || data[1] != 40 || len(data) != 42 {
+		t.Fatalf("unexpected encoding: %x", data[:2])
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := Marshal(struct{}{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestExt(t *testing.T) {
+	data, err := Marshal(Ext{0, []byte{1, 2, 3, 4, 5, 6, 7, 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(data) != "d7000102030405060708" {
+		t.Fatalf("unexpected encoding: %x", data)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	value := map[string]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"int":    int64(-300),
+		"uint":   int64(70000),
+		"float":  1.5,
+		"string": strings.Repeat("s", 40),
+		"bin":    []byte{1, 2},
+		"array":  []interface{}{int64(1), "a"},
+		"ext":    Ext{5, []byte{1, 2, 3}},
+	}
+	data, err := Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, value) {
+		t.Fatalf("Unmarshal(Marshal(%#v)) = %#v", value, decoded)
+	}
+
+	if _, err = Unmarshal(data[:len(data)-1]); err == nil {
+		t.Fatal("expected an error decoding truncated data")
+	}
+}
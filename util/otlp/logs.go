@@ -0,0 +1,187 @@
+// otlp implements encoding of OpenTelemetry (OTLP) logs export
+// requests, as protobuf or JSON, without depending on the generated
+// protobuf packages.
+// https://github.com/open-telemetry/opentelemetry-proto
+package otlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Severity numbers of log records.
+const (
+	SEVERITY_UNSPECIFIED = 0
+	SEVERITY_DEBUG       = 5
+	SEVERITY_INFO        = 9
+	SEVERITY_INFO2       = 10
+	SEVERITY_WARN        = 13
+	SEVERITY_ERROR       = 17
+	SEVERITY_ERROR2      = 18
+	SEVERITY_ERROR3      = 19
+	SEVERITY_FATAL       = 21
+)
+
+// KeyValue is an attribute, whose value must be a string, bool,
+// int64 or float64.
+type KeyValue struct {
+	Key   string
+	Value interface{}
+}
+
+// LogRecord is a single log record.
+type LogRecord struct {
+	Time           time.Time
+	ObservedTime   time.Time
+	SeverityNumber int32
+	SeverityText   string
+	Body           string
+	Attributes     []KeyValue
+}
+
+// ResourceLogs are the log records of a resource (eg: a host, or an
+// application instance), described by its attributes.
+type ResourceLogs struct {
+	Resource []KeyValue
+	Records  []LogRecord
+}
+
+// Request is an ExportLogsServiceRequest, with the log records of all
+// resources coming from the same instrumentation scope.
+type Request struct {
+	ScopeName    string
+	ScopeVersion string
+	ResourceLogs []ResourceLogs
+}
+
+// MarshalProtobuf returns the protobuf encoding of the request.
+func (r *Request) MarshalProtobuf() ([]byte, error) {
+	var e Encoder
+	for _, rl := range r.ResourceLogs {
+		var err error
+		e.Message(1, func(e *Encoder) {
+			e.Message(1, func(e *Encoder) {
+				err = encodeAttributes(e, 1, rl.Resource)
+			})
+			e.Message(2, func(e *Encoder) {
+				e.Message(1, func(e *Encoder) {
+					e.Str(1, r.ScopeName)
+					e.Str(2, r.ScopeVersion)
+				})
+				for _, record := range rl.Records {
+					e.Message(2, func(e *Encoder) {
+						if rerr := encodeRecord(e, record); rerr != nil {
+							err = rerr
+						}
+					})
+				}
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.Data(), nil
+}
+
+func encodeRecord(e *Encoder, record LogRecord) error {
+	e.Fixed64(1, unixNano(record.Time))
+	e.Varint(2, int64(record.SeverityNumber))
+	e.Str(3, record.SeverityText)
+	e.Message(5, func(e *Encoder) {
+		e.Str(1, record.Body)
+	})
+	if err := encodeAttributes(e, 6, record.Attributes); err != nil {
+		return err
+	}
+	e.Fixed64(11, unixNano(record.ObservedTime))
+	return nil
+}
+
+func encodeAttributes(e *Encoder, field int, attributes []KeyValue) error {
+	var err error
+	for _, kv := range attributes {
+		e.Message(field, func(e *Encoder) {
+			e.Str(1, kv.Key)
+			e.Message(2, func(e *Encoder) {
+				switch v := kv.Value.(type) {
+				case string:
+					e.Str(1, v)
+				case bool:
+					e.Bool(2, v)
+				case int64:
+					e.Varint(3, v)
+				case float64:
+					e.Double(4, v)
+				default:
+					err = fmt.Errorf("unsupported attribute value %v (%T)", v, v)
+				}
+			})
+		})
+	}
+	return err
+}
+
+// MarshalJSON returns the OTLP/JSON encoding of the request (the
+// protobuf JSON mapping, with 64-bit integers as strings).
+func (r *Request) MarshalJSON() ([]byte, error) {
+	resourceLogs := make([]interface{}, 0, len(r.ResourceLogs))
+	for _, rl := range r.ResourceLogs {
+		resource, err := jsonAttributes(rl.Resource)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]interface{}, 0, len(rl.Records))
+		for _, record := range rl.Records {
+			attributes, err := jsonAttributes(record.Attributes)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, map[string]interface{}{
+				"timeUnixNano":         strconv.FormatUint(unixNano(record.Time), 10),
+				"observedTimeUnixNano": strconv.FormatUint(unixNano(record.ObservedTime), 10),
+				"severityNumber":       record.SeverityNumber,
+				"severityText":         record.SeverityText,
+				"body":                 map[string]interface{}{"stringValue": record.Body},
+				"attributes":           attributes})
+		}
+		resourceLogs = append(resourceLogs, map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{
+					"name": r.ScopeName, "version": r.ScopeVersion},
+				"logRecords": records}}})
+	}
+	return json.Marshal(map[string]interface{}{"resourceLogs": resourceLogs})
+}
+
+func jsonAttributes(attributes []KeyValue) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(attributes))
+	for _, kv := range attributes {
+		var value map[string]interface{}
+		switch v := kv.Value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int64:
+			// 64-bit integers are strings in JSON.
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			return nil, fmt.Errorf("unsupported attribute value %v (%T)", v, v)
+		}
+		values = append(values, map[string]interface{}{"key": kv.Key, "value": value})
+	}
+	return values, nil
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
@@ -0,0 +1,68 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testRequest() *Request {
+	return &Request{
+		ScopeName: "s",
+		ResourceLogs: []ResourceLogs{{
+			Resource: []KeyValue{{"k", "v"}},
+			Records: []LogRecord{{
+				Time:           time.Unix(1, 0),
+				SeverityNumber: SEVERITY_INFO,
+				Body:           "b"}}}}}
+}
+
+func TestMarshalProtobuf(t *testing.T) {
+	data, err := testRequest().MarshalProtobuf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "0a25" +
+		"0a0a" + "0a08" + "0a016b" + "12030a0176" + // resource
+		"1217" + "0a030a0173" + // scope
+		"1210" + "0900ca9a3b00000000" + "1009" + "2a030a0162" // record
+	if hex.EncodeToString(data) != expected {
+		t.Fatalf("unexpected encoding: %x", data)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	request := testRequest()
+	request.ResourceLogs[0].Records[0].Attributes = []KeyValue{{"n", int64(2)}}
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded, expected interface{}
+	json.Unmarshal(data, &decoded)
+	json.Unmarshal([]byte(`{"resourceLogs": [{
+		"resource": {"attributes": [{"key": "k", "value": {"stringValue": "v"}}]},
+		"scopeLogs": [{
+			"scope": {"name": "s", "version": ""},
+			"logRecords": [{
+				"timeUnixNano": "1000000000",
+				"observedTimeUnixNano": "0",
+				"severityNumber": 9,
+				"severityText": "",
+				"body": {"stringValue": "b"},
+				"attributes": [{"key": "n", "value": {"intValue": "2"}}]}]}]}]}`),
+		&expected)
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("unexpected encoding: %s", data)
+	}
+}
+
+func TestUnsupportedAttribute(t *testing.T) {
+	request := Request{ResourceLogs: []ResourceLogs{{
+		Resource: []KeyValue{{"k", 1}}}}}
+	if _, err := request.MarshalProtobuf(); err == nil {
+		t.Fatal("expected an error encoding an int attribute")
+	}
+}
@@ -0,0 +1,99 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protobuf wire types.
+const (
+	WIRE_VARINT  = 0
+	WIRE_FIXED64 = 1
+	WIRE_BYTES   = 2
+	WIRE_FIXED32 = 5
+)
+
+// Encoder appends protobuf encoded fields to a buffer. Fields with the
+// default (zero) value are omitted, as proto3 does.
+type Encoder struct {
+	buf []byte
+}
+
+// Data returns the encoded fields.
+func (e *Encoder) Data() []byte {
+	return e.buf
+}
+
+func (e *Encoder) tag(field, wireType int) {
+	e.varint(uint64(field<<3 | wireType))
+}
+
+func (e *Encoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+// Varint encodes an int32, int64, uint32, uint64, bool or enum field.
+func (e *Encoder) Varint(field int, v int64) {
+	if v != 0 {
+		e.tag(field, WIRE_VARINT)
+		e.varint(uint64(v))
+	}
+}
+
+// Bool encodes a bool field.
+func (e *Encoder) Bool(field int, v bool) {
+	if v {
+		e.Varint(field, 1)
+	}
+}
+
+// Fixed64 encodes a fixed64 field.
+func (e *Encoder) Fixed64(field int, v uint64) {
+	if v != 0 {
+		e.tag(field, WIRE_FIXED64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], v)
+		e.buf = append(e.buf, b[:]...)
+	}
+}
+
+// Double encodes a double field.
+func (e *Encoder) Double(field int, v float64) {
+	if v != 0 {
+		e.tag(field, WIRE_FIXED64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		e.buf = append(e.buf, b[:]...)
+	}
+}
+
+// Bytes encodes a bytes field.
+func (e *Encoder) Bytes(field int, v []byte) {
+	if len(v) > 0 {
+		e.tag(field, WIRE_BYTES)
+		e.varint(uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Str encodes a string field.
+func (e *Encoder) Str(field int, v string) {
+	if v != "" {
+		e.tag(field, WIRE_BYTES)
+		e.varint(uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Message encodes an embedded message field, whose fields are encoded
+// by fn. Unlike other fields, it is encoded even if empty (as
+// needed for repeated fields and oneofs).
+func (e *Encoder) Message(field int, fn func(*Encoder)) {
+	var m Encoder
+	fn(&m)
+	e.tag(field, WIRE_BYTES)
+	e.varint(uint64(len(m.buf)))
+	e.buf = append(e.buf, m.buf...)
+}
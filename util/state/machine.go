@@ -5,6 +5,7 @@ import (
 	"github.com/ActiveState/log"
 	"logyard/util/retry"
 	"sync"
+	"time"
 )
 
 type StateChangedFn func(State, int64)
@@ -18,6 +19,16 @@ type StateMachine struct {
 	rev     int64
 	fn      StateChangedFn
 	mux     sync.Mutex
+	since   time.Time // when the current state was entered
+	lastErr string    // last error reported by a state, if any
+}
+
+// Status is a snapshot of a state machine.
+type Status struct {
+	State     State
+	Rev       int64
+	Since     time.Time // when State was entered
+	LastError string    // last error reported by any state, if any
 }
 
 func NewStateMachine(title string, process Process, retryer retry.Retryer, fn StateChangedFn) *StateMachine {
@@ -35,6 +46,10 @@ func NewStateMachine(title string, process Process, retryer retry.Retryer, fn St
 func (m *StateMachine) transition(state State, rev int64) {
 	m.state = state
 	m.rev = rev
+	m.since = time.Now()
+	if err, ok := state.Info()["error"]; ok {
+		m.lastErr = err
+	}
 	if m.fn != nil {
 		m.fn(m.state, m.rev)
 	}
@@ -65,6 +80,27 @@ func (m *StateMachine) GetState() State {
 	return m.state
 }
 
+// Restart stops the process, if running, and starts it again, from
+// whichever state (eg: FATAL) it is in. Future retries are made as
+// per the given, fresh, retryer.
+func (m *StateMachine) Restart(retryer retry.Retryer) error {
+	m.mux.Lock()
+	m.retryer = retryer
+	m.mux.Unlock()
+	if err := m.SendAction(STOP); err != nil {
+		return err
+	}
+	return m.SendAction(START)
+}
+
+// GetStatus returns the current state along with its revision, when
+// it was entered and the last error seen.
+func (m *StateMachine) GetStatus() Status {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return Status{m.state, m.rev, m.since, m.lastErr}
+}
+
 func (m *StateMachine) Stop() {
 	m.Log("Stopping STM...")
 	m.mux.Lock()
@@ -151,17 +187,17 @@ func (s *StateMachine) monitor(rev int64) {
 	} else {
 		s.setStateCustom(rev, func() State {
 			rev = rev + 1 // account for setting of RetryingState
-			go s.doretry(rev, err)
+			go s.doretry(rev, err, s.retryer)
 			return Retrying{err, s}
 		})
 	}
 }
 
-func (s *StateMachine) doretry(rev int64, err error) {
+func (s *StateMachine) doretry(rev int64, err error, retryer retry.Retryer) {
 	retryMsg := fmt.Sprintf(s.process.Logf(
 		"[STM] %s exited abruptly -- %v", s.title, err))
 	// retryer.Wait generally blocks on time.Sleep.
-	if s.retryer.Wait(retryMsg) {
+	if retryer.Wait(retryMsg) {
 		s.setStateCustom(rev, func() State {
 			return s.start(rev)
 		})
@@ -76,3 +76,37 @@ func TestRetry(t *testing.T) {
 			&ThriceRetryer{},
 			nil))
 }
+
+// Test restarting a process that went FATAL after exhausting its
+// retries.
+func TestRestartFatal(t *testing.T) {
+	m := state.NewStateMachine(
+		"DummyProcess",
+		&MockProcess{
+			"restart",
+			time.Duration(10 * time.Millisecond),
+			fmt.Errorf("exiting after 10ms"),
+			nil},
+		&NoopRetryer{},
+		nil)
+	seq := Sequence([]interface{}{
+		SeqAction(state.START),
+		SeqDelay(50 * time.Millisecond),
+		SeqState("FATAL"),
+	})
+	seq.Test(t, m)
+
+	if err := m.Restart(&ThriceRetryer{}); err != nil {
+		t.Fatal(err)
+	}
+	seq = Sequence([]interface{}{
+		SeqDelay(5 * time.Millisecond),
+		SeqState("RUNNING|STARTING"),
+		SeqDelay(30 * time.Millisecond),
+		SeqState("RUNNING|RETRYING|STARTING"),
+	})
+	seq.Test(t, m)
+	if status := m.GetStatus(); status.LastError == "" {
+		t.Fatal("expected the last error to be kept")
+	}
+}
@@ -0,0 +1,150 @@
+// templatefuncs provides the functions available in drain formats
+// and `logyard-cli stream` print formats, in addition to the ones
+// builtin to text/template.
+//
+//	json VALUE            JSON encoding of VALUE (eg: a JSON-escaped, quoted string)
+//	time LAYOUT VALUE     format a unix timestamp (seconds) using LAYOUT, which is
+//	                      either a Go time layout or one of: rfc3339, rfc3339nano,
+//	                      rfc1123, rfc5424, stamp, kitchen. Times are in UTC.
+//	default DEF VALUE     VALUE, or DEF if VALUE is missing or empty
+//	trunc N VALUE         VALUE truncated to at most N characters
+//	lower VALUE           VALUE in lower case
+//	upper VALUE           VALUE in upper case
+//	replace OLD NEW VALUE VALUE with all occurrences of OLD replaced by NEW
+//	env NAME              value of the environment variable NAME
+//	hostname              host name of the node
+//
+// The last argument can be piped in, as in:
+//
+//	{{.severity | default "INFO" | upper}}
+package templatefuncs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// FuncMap is the function map to be passed to template.Funcs.
+var FuncMap = template.FuncMap{
+	"json":     jsonFn,
+	"time":     timeFn,
+	"default":  defaultFn,
+	"trunc":    truncFn,
+	"lower":    lowerFn,
+	"upper":    upperFn,
+	"replace":  replaceFn,
+	"env":      os.Getenv,
+	"hostname": hostnameFn,
+}
+
+var timeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123,
+	"rfc5424":     "2006-01-02T15:04:05.000000Z07:00",
+	"stamp":       time.Stamp,
+	"kitchen":     time.Kitchen,
+}
+
+// New returns a new template with the given name, with FuncMap
+// installed.
+func New(name string) *template.Template {
+	return template.New(name).Funcs(FuncMap)
+}
+
+func jsonFn(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func timeFn(layout string, v interface{}) (string, error) {
+	var secs float64
+	switch ts := v.(type) {
+	case float64:
+		secs = ts
+	case int:
+		secs = float64(ts)
+	case int64:
+		secs = float64(ts)
+	case string:
+		var err error
+		if secs, err = strconv.ParseFloat(ts, 64); err != nil {
+			return "", fmt.Errorf("not a unix timestamp: %q", ts)
+		}
+	default:
+		return "", fmt.Errorf("not a unix timestamp: %v", v)
+	}
+	if named, ok := timeLayouts[layout]; ok {
+		layout = named
+	}
+	whole := int64(secs)
+	nsecs := int64((secs - float64(whole)) * 1e9)
+	return time.Unix(whole, nsecs).UTC().Format(layout), nil
+}
+
+func defaultFn(def interface{}, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	if s, ok := v.(string); ok && s == "" {
+		return def
+	}
+	return v
+}
+
+func truncFn(n int, v interface{}) string {
+	runes := []rune(toString(v))
+	if n >= 0 && len(runes) > n {
+		return string(runes[:n])
+	}
+	return string(runes)
+}
+
+func lowerFn(v interface{}) string {
+	return strings.ToLower(toString(v))
+}
+
+func upperFn(v interface{}) string {
+	return strings.ToUpper(toString(v))
+}
+
+func replaceFn(old, new string, v interface{}) string {
+	return strings.Replace(toString(v), old, new, -1)
+}
+
+// hostname is looked up once, as templates of different drains are
+// executed concurrently.
+var (
+	hostname     string
+	hostnameOnce sync.Once
+)
+
+func hostnameFn() string {
+	hostnameOnce.Do(func() {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			hostname = "localhost"
+		}
+	})
+	return hostname
+}
+
+// toString converts a (decoded JSON) value to its string
+// representation, as printed by the template.
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,62 @@
+package templatefuncs
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestFuncs(t *testing.T) {
+	record := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{
+		"text": "say \"hi\"",
+		"unix_time": 1366327512.5,
+		"severity": "warn",
+		"app_name": "env-app",
+		"instance_index": 3}`), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		`{{json .text}}`:                        `"say \"hi\""`,
+		`{{.unix_time | time "rfc3339"}}`:       `2013-04-18T23:25:12Z`,
+		`{{.unix_time | time "15:04:05.000"}}`:  `23:25:12.500`,
+		`{{.missing | default "-"}}`:            `-`,
+		`{{.severity | default "-" | upper}}`:   `WARN`,
+		`{{.app_name | trunc 3}}`:               `env`,
+		`{{.text | lower}}`:                     `say "hi"`,
+		`{{.instance_index | lower}}`:           `3`,
+		`{{.app_name | replace "-" "_"}}`:       `env_app`,
+		`{{env "LOGYARD_TEMPLATEFUNCS_UNSET"}}`: ``,
+	}
+
+	for format, expected := range tests {
+		tmpl, err := New("test").Parse(format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, record); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if buf.String() != expected {
+			t.Fatalf("%s: expected `%s`; got `%s`", format, expected, buf.String())
+		}
+	}
+}
+
+func TestHostname(t *testing.T) {
+	// Formats of several drains may call it concurrently.
+	hostnames := make(chan string)
+	for i := 0; i < 4; i++ {
+		go func() {
+			hostnames <- hostnameFn()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if <-hostnames == "" {
+			t.Fatal("empty hostname")
+		}
+	}
+}